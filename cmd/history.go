@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Define the 'history' subcommand
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Print every data migration that has been applied or reverted",
+	Run: func(cmd *cobra.Command, args []string) {
+		asJson, _ := cmd.Flags().GetBool("json")
+
+		m, conn, err := newMigrator(cmd)
+		if err != nil {
+			log.Fatalf("An error occurred: %v", err)
+		}
+		defer conn.Close()
+
+		history, err := m.History(cmd.Context())
+		if err != nil {
+			log.Fatalf("An error occurred: %v", err)
+		}
+
+		if asJson {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(history); err != nil {
+				log.Fatalf("An error occurred while encoding the history: %v", err)
+			}
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tDIRECTION\tAPPLIED AT\tDURATION\tROWS\tCHECKSUM\tHOST\tUSER")
+		for _, h := range history {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+				h.Version, h.Direction, h.AppliedAt.Format(time.RFC3339), h.Duration, h.Rows,
+				shortChecksum(h.Checksum), h.Hostname, h.User)
+		}
+		w.Flush()
+	},
+}
+
+func shortChecksum(checksum string) string {
+	if len(checksum) > 12 {
+		return checksum[:12]
+	}
+	return checksum
+}
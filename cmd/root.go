@@ -1,16 +1,23 @@
 package cmd
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"syscall"
 
 	"github.com/datamigrate/csv"
-	"github.com/datamigrate/db"
 	dm "github.com/datamigrate/migration"
+	"github.com/datamigrate/migrator"
 	"github.com/datamigrate/utils"
-	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/cobra"
 )
 
@@ -28,20 +35,46 @@ func init() {
 	// Add a database flag
 	rootCmd.PersistentFlags().StringP("conn", "c", "", "Database URL")
 	// Add a path flag
-	rootCmd.PersistentFlags().StringP("path", "p", "", "Migrations directory")
+	rootCmd.PersistentFlags().StringP("path", "p", "", "Migrations directory or file:// URL")
 	// Add a datapath flag
 	rootCmd.PersistentFlags().StringP("datapath", "d", "", "Data Migrations directory")
 	// Add subcommands: up, down, and create
 
 	createCmd.Flags().StringP("version", "v", "", "The migration version to pin the datamigration to")
+	createCmd.Flags().String("csv", "", "The CSV to load, possibly compressed, e.g. data/users.csv.gz")
+	upCmd.Flags().Bool("atomic", false, "Apply all pending data migrations in a single transaction")
+	upCmd.Flags().Bool("fail-on-drift", false, "Fail if an applied data migration has changed since it was applied")
+	upCmd.Flags().Bool("reapply-changed", false, "Reload the tables of applied data migrations that have changed since they were applied")
+	// Add the lock flags to the commands that migrate
+	for _, c := range []*cobra.Command{upCmd, downCmd, gotoCmd, forceCmd} {
+		c.Flags().Bool("no-lock", false, "Do not take the advisory lock that keeps concurrent migrations out")
+		c.Flags().Duration("lock-timeout", migrator.DefaultLockTimeout, "How long to wait for another migration to release the lock")
+	}
 
 	// add example
 	rootCmd.Example = `datamigrate up -c "postgres://localhost:5432/<db-name>" -p "./migrations" -d "./datamigrations"`
 	// add example for create
 	createCmd.Example = `datamigrate create -v "000001" -p "./migrations" -d "./datamigrations"`
+	// add example for goto
+	gotoCmd.Example = `datamigrate goto 2 -c "postgres://localhost:5432/<db-name>" -p "./migrations" -d "./datamigrations"`
+	// add example for force
+	forceCmd.Example = `datamigrate force 2 -c "postgres://localhost:5432/<db-name>"`
+
+	statusCmd.Flags().Bool("json", false, "Print the status as JSON")
+	statusCmd.Flags().Bool("fail-on-drift", false, "Exit with an error if an applied data migration has changed since it was applied")
+	// add example for status
+	statusCmd.Example = `datamigrate status --json -c "postgres://localhost:5432/<db-name>" -p "./migrations" -d "./datamigrations"`
+
+	historyCmd.Flags().Bool("json", false, "Print the history as JSON")
+	// add example for history
+	historyCmd.Example = `datamigrate history -c "postgres://localhost:5432/<db-name>"`
 	rootCmd.AddCommand(upCmd)
 	rootCmd.AddCommand(downCmd)
 	rootCmd.AddCommand(createCmd)
+	rootCmd.AddCommand(gotoCmd)
+	rootCmd.AddCommand(forceCmd)
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(historyCmd)
 }
 
 // Define the 'up' subcommand
@@ -49,97 +82,27 @@ var upCmd = &cobra.Command{
 	Use:   "up",
 	Short: "Run data migrations up",
 	Run: func(cmd *cobra.Command, args []string) {
-		dbUrl := cmd.Flag("conn").Value.String()
-		// read the migrations from the data migrations directory
-		dataMigrationsDir := cmd.Flag("datapath").Value.String()
-
-		m, version, err := connectAndCheckVersion(cmd)
+		m, conn, err := newMigrator(cmd)
 		if err != nil {
 			log.Fatalf("An error occurred: %v", err)
 		}
+		defer conn.Close()
 
-		// connect to the database with sql.Open
-		conn, err := sql.Open("postgres", dbUrl)
-		if err != nil {
-			log.Fatalf("An error occurred while connecting to the database: %v", err)
-		}
-		// check if the data migration table exists
-		dataMigrationTableExists := db.CheckDataMigrationTableExists(conn)
-		if !dataMigrationTableExists {
-			// create the data migration table
-			err = db.CreateDataMigrationTable(conn)
-			if err != nil {
-				log.Fatalf("An error occurred while creating the data migration table: %v", err)
-			}
-		}
-
-		// get the current datamigration version from the db
-		currentDataMigrationVersion, err := db.GetVersion(conn)
-		if err != nil {
-			log.Printf("An error occurred while getting the current data migration version: %v", err)
-		}
-
-		if currentDataMigrationVersion == version {
-			log.Printf("The current data migration version is the same as the target version: %v", version)
-			return
-		}
-
-		// get all the data migrations
-
-		log.Println("Current data migration version", currentDataMigrationVersion)
+		m.Atomic, _ = cmd.Flags().GetBool("atomic")
+		m.FailOnDrift, _ = cmd.Flags().GetBool("fail-on-drift")
+		m.ReapplyChanged, _ = cmd.Flags().GetBool("reapply-changed")
 
-		dataMigrationsDirAbs, err := filepath.Abs(dataMigrationsDir)
-		if err != nil {
-			log.Fatalf("An error occurred while getting the absolute path of the data migrations directory: %v", err)
+		var loaded, rejected int64
+		m.OnLoad = func(result migrator.LoadResult) {
+			loaded += result.Loaded
+			rejected += result.Rejected
 		}
-		log.Println("Reading data migrations from", dataMigrationsDirAbs)
-		dataMigrations, err := dm.ReadDataMigrations(dataMigrationsDirAbs)
 
+		err = m.Up(cmd.Context())
 		if err != nil {
-			log.Fatalf("An error occurred while reading the data migrations: %v", err)
-		}
-
-		// log.Println("Data migrations", dataMigrations)
-
-		availableVersions, err := dm.ParseVersions(dataMigrations)
-		if err != nil {
-			log.Fatalf("An error occurred while parsing the versions: %v", err)
-		}
-		// range over the available versions
-		for _, targetVersion := range availableVersions {
-			// find the data migration with the corresponding version
-			dataMigration := dm.GetDataMigrationByVersion(dataMigrations, targetVersion)
-			if dataMigration == nil {
-				log.Fatalf("Data migration with version %d not found", targetVersion)
-			}
-
-			fmt.Printf("Running migration file for version: %d %s\n", targetVersion, dataMigration.CSVPath)
-
-			// load the csv
-			c, err := csv.LoadCSV(dataMigration.CSVPath, dataMigration.Delimiter)
-			if err != nil {
-				log.Fatalf("An error occurred while loading the csv: %v", err)
-			}
-			// validate the csv columns against the migration columns
-			err = csv.ValidateColumns(c, dataMigration)
-
-			if err != nil {
-				log.Fatalf("Column order mismatch: %v", err)
-			}
-			// load the csv to the database
-			err = db.WriteCsvToDb(conn, c, dataMigration.Table)
-			if err != nil {
-				log.Fatalf("An error occurred while writing the csv to the database: %v", err)
-			}
-
-			db.SetVersion(conn, int(targetVersion))
-
-			log.Println("Data migration completed successfully")
-
+			log.Fatalf("An error occurred: %v", err)
 		}
-		defer conn.Close()
-		defer m.Close()
-
+		log.Printf("Loaded %d rows, rejected %d rows", loaded, rejected)
 	},
 }
 
@@ -148,65 +111,17 @@ var downCmd = &cobra.Command{
 	Use:   "down",
 	Short: "Revert data migrations down",
 	Run: func(cmd *cobra.Command, args []string) {
-		m, _, err := connectAndCheckVersion(cmd)
+		m, conn, err := newMigrator(cmd)
 		if err != nil {
 			log.Fatalf("An error occurred: %v", err)
 		}
-		// check the data migration table exists
-		dbUrl := cmd.Flag("conn").Value.String()
-		// get all the data migrations
-		dataMigrationsDir := cmd.Flag("datapath").Value.String()
-
-		conn, err := sql.Open("postgres", dbUrl)
-		if err != nil {
-			log.Fatalf("An error occurred while connecting to the database: %v", err)
-		}
-
-		currentDataMigrationVersion, err := db.GetVersion(conn)
-		if err != nil {
-			log.Fatalf("An error occurred while getting the current data migration version: %v", err)
-		}
-		if currentDataMigrationVersion == 0 {
-			log.Printf("The current data migration version is 0. Nothing to do. Exiting...")
-			return
-		}
-
-		log.Println("Current data migration version", currentDataMigrationVersion)
-
-		dataMigrationsDirAbs, err := filepath.Abs(dataMigrationsDir)
-		if err != nil {
-			log.Fatalf("An error occurred while getting the absolute path of the data migrations directory: %v", err)
-		}
+		defer conn.Close()
 
-		dataMigrations, err := dm.ReadDataMigrations(dataMigrationsDirAbs)
-		if err != nil {
-			log.Fatalf("An error occurred while reading the data migrations: %v", err)
-		}
-		// get the versions
-		availableVersions, err := dm.ParseVersions(dataMigrations)
-		log.Println("Available versions", availableVersions)
-		// for range reversed over the available versions
-		for i := len(availableVersions) - 1; i >= 0; i-- {
-			v := availableVersions[i]
-			log.Println("Truncating table for version", v)
-			dataMigration := dm.GetDataMigrationByVersion(dataMigrations, v)
-			if dataMigration == nil {
-				log.Fatalf("Data migration with version %d not found", v)
-			}
-			fmt.Printf("Loading file for version: %d %s\n", v, dataMigration.CSVPath)
-			db.TruncateTable(conn, dataMigration.Table)
-			db.SetVersion(conn, int(v))
-
-		}
-
-		// set the version to 0
-		db.SetVersion(conn, 0)
-		log.Println("Data migrations reverted successfully")
+		err = m.Down(cmd.Context())
 		if err != nil {
 			log.Fatalf("An error occurred: %v", err)
 		}
-		defer m.Close()
-
+		log.Println("Data migrations reverted successfully")
 	},
 }
 
@@ -246,13 +161,21 @@ var createCmd = &cobra.Command{
 		}
 		log.Println("Creating a new data migration in", migrationDirAbs)
 
-		// get all the files in the migrations directory
-		migrationFiles, err := utils.GetMigrations(sqlMigrationsDir)
+		// read the migrations through their golang-migrate source driver
+		sourceURL, err := utils.GetAbsoluteSourceDir(sqlMigrationsDir)
+		if err != nil {
+			log.Fatalf("An error occurred: %v", err)
+		}
+		driver, err := source.Open(sourceURL)
 		if err != nil {
-			log.Fatalf("An error occurred while getting the migrations: %v", err)
+			log.Fatalf("An error occurred while opening the migrations: %v", err)
 		}
+		defer driver.Close()
 
-		migrations := dm.ParseMigrationObjects(migrationFiles)
+		migrations, err := dm.ReadMigrations(driver)
+		if err != nil {
+			log.Fatalf("An error occurred while parsing the migrations: %v", err)
+		}
 		// get the migration with the corresponding version
 		migration := dm.GetMigrationByVersion(migrations, version, dm.Up)
 		if migration == nil {
@@ -270,10 +193,12 @@ var createCmd = &cobra.Command{
 		dataMigration := &dm.DataMigration{
 			Migration: migration,
 			Path:      mPath,
+			CSVPath:   cmd.Flag("csv").Value.String(),
 		}
 
 		// create the empty data migration files
-		path, err := dm.CreateMigrationFile(dataMigration, migration)
+		exists := func(path string) error { return csv.Exists(cmd.Context(), path, csv.Options{}) }
+		path, err := dm.CreateMigrationFile(dataMigration, migration, exists)
 		if err != nil {
 			log.Fatalf("An error occurred while creating the data migration file: %v", err)
 		}
@@ -282,45 +207,102 @@ var createCmd = &cobra.Command{
 	},
 }
 
+// Define the 'goto' subcommand
+var gotoCmd = &cobra.Command{
+	Use:   "goto <version>",
+	Short: "Migrate data up or down to a specific version",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		targetVersion, err := strconv.Atoi(args[0])
+		if err != nil || targetVersion < 0 {
+			log.Fatalf("Invalid version %q: the version must be a non-negative integer", args[0])
+		}
+
+		m, conn, err := newMigrator(cmd)
+		if err != nil {
+			log.Fatalf("An error occurred: %v", err)
+		}
+		defer conn.Close()
+
+		err = m.Goto(cmd.Context(), targetVersion)
+		if err != nil {
+			log.Fatalf("An error occurred: %v", err)
+		}
+	},
+}
+
+// Define the 'force' subcommand
+var forceCmd = &cobra.Command{
+	Use:   "force <version>",
+	Short: "Set the data migration version and clear the dirty flag",
+	Long: `Set the data migration version without running any data migration and clear the dirty flag.
+Use this after a failed data migration has been fixed by hand.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		version, err := strconv.Atoi(args[0])
+		if err != nil || version < 0 {
+			log.Fatalf("Invalid version %q: the version must be a non-negative integer", args[0])
+		}
+
+		m, conn, err := newMigrator(cmd)
+		if err != nil {
+			log.Fatalf("An error occurred: %v", err)
+		}
+		defer conn.Close()
+
+		err = m.Force(cmd.Context(), version)
+		if err != nil {
+			log.Fatalf("An error occurred: %v", err)
+		}
+		log.Printf("Data migration version forced to %d", version)
+	},
+}
+
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	// cancel the running data migration on Ctrl-C or SIGTERM, rolling back its transaction
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		log.Fatalf("An error occurred while executing the root command: %v", err)
 	}
 }
 
-func connectAndCheckVersion(cmd *cobra.Command) (*migrate.Migrate, uint, error) {
-	// Get the db url from the environment variables
+// newMigrator opens the database from the conn flag and builds a Migrator for
+// the path and datapath flags. The caller closes the returned connection.
+func newMigrator(cmd *cobra.Command) (*migrator.Migrator, *sql.DB, error) {
 	dbUrl := cmd.Flag("conn").Value.String()
 
-	// Connect to the database
-	driver, err := db.ConnectDatabase(dbUrl)
+	// connect to the database with sql.Open
+	conn, err := sql.Open("postgres", dbUrl)
 	if err != nil {
-		return nil, 0, fmt.Errorf("an error occurred while connecting to the database: %v", err)
+		return nil, nil, fmt.Errorf("an error occurred while connecting to the database: %w", err)
 	}
 
-	sourceDir := cmd.Flag("path").Value.String()
-	if sourceDir == "" {
-		return nil, 0, fmt.Errorf("the migrations directory is required")
+	// the schema migrations are only needed by the commands that read the schema version
+	var sourceURL string
+	if sourceDir := cmd.Flag("path").Value.String(); sourceDir != "" {
+		sourceURL, err = utils.GetAbsoluteSourceDir(sourceDir)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
 	}
 
-	sourceDirAbs := utils.GetAbsoluteSourceDir(sourceDir)
-
-	m, err := migrate.NewWithDatabaseInstance(
-		sourceDirAbs,
-		"postgres", driver)
-
+	dataMigrationsDirAbs, err := filepath.Abs(cmd.Flag("datapath").Value.String())
 	if err != nil {
-		return nil, 0, fmt.Errorf("an error occurred while creating the migration instance: %v", err)
+		conn.Close()
+		return nil, nil, fmt.Errorf("an error occurred while getting the absolute path of the data migrations directory: %w", err)
 	}
 
-	// Get the current version
-	version, dirty, err := m.Version()
-	if err != nil {
-		return nil, 0, fmt.Errorf("an error occurred while getting the current version: %v", err)
+	m := migrator.New(conn, sourceURL, dataMigrationsDirAbs)
+	m.Logger = log.Default()
+	m.Progress = func(path string, size int64) io.Writer {
+		return progressbar.DefaultBytes(size, "Loading CSV from path: "+path)
 	}
-	if dirty {
-		return nil, 0, fmt.Errorf("the current version is dirty. Please fix state to continue")
+	if cmd.Flags().Lookup("no-lock") != nil {
+		m.NoLock, _ = cmd.Flags().GetBool("no-lock")
+		m.LockTimeout, _ = cmd.Flags().GetDuration("lock-timeout")
 	}
-
-	return m, version, nil
+	return m, conn, nil
 }
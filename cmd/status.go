@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/datamigrate/migrator"
+	"github.com/spf13/cobra"
+)
+
+// Define the 'status' subcommand
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "List every data migration and its state",
+	Run: func(cmd *cobra.Command, args []string) {
+		asJson, _ := cmd.Flags().GetBool("json")
+
+		m, conn, err := newMigrator(cmd)
+		if err != nil {
+			log.Fatalf("An error occurred: %v", err)
+		}
+		defer conn.Close()
+
+		status, err := m.Status(cmd.Context())
+		if err != nil {
+			log.Fatalf("An error occurred: %v", err)
+		}
+
+		if asJson {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(status); err != nil {
+				log.Fatalf("An error occurred while encoding the status: %v", err)
+			}
+		} else {
+			printStatus(status)
+		}
+
+		drifted := status.Drifted()
+		if failOnDrift, _ := cmd.Flags().GetBool("fail-on-drift"); failOnDrift && len(drifted) > 0 {
+			log.Fatalf("Data migrations %v have changed since they were applied", drifted)
+		}
+	},
+}
+
+func printStatus(status *migrator.Status) {
+	fmt.Printf("Schema version: %d%s\n", status.SchemaVersion, dirtySuffix(status.SchemaDirty))
+	fmt.Printf("Data version:   %d%s\n\n", status.DataVersion, dirtySuffix(status.DataDirty))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tTABLE\tCSV\tROWS\tSTATE\tMODIFIED")
+	for _, s := range status.DataMigrations {
+		modified := ""
+		if s.Modified {
+			modified = "yes"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\n", s.Version, s.Table, s.CSVPath, s.Rows, s.State, modified)
+	}
+	w.Flush()
+}
+
+func dirtySuffix(dirty bool) string {
+	if dirty {
+		return " (dirty)"
+	}
+	return ""
+}
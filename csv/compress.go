@@ -0,0 +1,89 @@
+package csv
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// The compression formats of a CSV.
+const (
+	Gzip  = "gzip"
+	Zstd  = "zstd"
+	Bzip2 = "bzip2"
+	Xz    = "xz"
+)
+
+var compressionExts = map[string]string{
+	".gz":   Gzip,
+	".gzip": Gzip,
+	".zst":  Zstd,
+	".zstd": Zstd,
+	".bz2":  Bzip2,
+	".xz":   Xz,
+}
+
+var compressionMagic = []struct {
+	format string
+	magic  []byte
+}{
+	{Gzip, []byte{0x1f, 0x8b}},
+	{Zstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{Bzip2, []byte("BZh")},
+	{Xz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// Compression returns the compression format of a CSV from the extension of
+// its path, e.g. Gzip for users.csv.gz, or "" when the extension is not one
+// of a compressed file.
+func Compression(p string) string {
+	return compressionExts[strings.ToLower(path.Ext(localName(p)))]
+}
+
+// decompress returns the decompressed content of r. The format comes from the
+// magic bytes r starts with rather than the extension of path, so that r is
+// returned as is when it is not compressed, whatever its name. Closing the
+// result only releases the decoder, r is closed by the caller.
+func decompress(r io.Reader, path string) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	format := ""
+	for _, m := range compressionMagic {
+		if start, _ := br.Peek(len(m.magic)); bytes.Equal(start, m.magic) {
+			format = m.format
+			break
+		}
+	}
+
+	var dec io.ReadCloser
+	var err error
+	switch format {
+	case Gzip:
+		dec, err = gzip.NewReader(br)
+	case Zstd:
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(br)
+		if err == nil {
+			dec = zr.IOReadCloser()
+		}
+	case Bzip2:
+		dec = io.NopCloser(bzip2.NewReader(br))
+	case Xz:
+		var xr *xz.Reader
+		xr, err = xz.NewReader(br)
+		dec = io.NopCloser(xr)
+	default:
+		return io.NopCloser(br), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("an error occurred while reading the %s compressed csv %s: %w", format, path, err)
+	}
+	return dec, nil
+}
@@ -0,0 +1,106 @@
+package csv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const compressTestData = "id,name\n1,ann\n"
+
+// bzip2TestData is compressTestData compressed with bzip2, which the standard
+// library can only read.
+var bzip2TestData = []byte("\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\xa9\xf9\x59\x6f\x00\x00\x04\xd9\x00\x00\x10\x00\x04\x20\x00\x26\x23\x20\x00\x31\x06\x4c\x41\x01\xb5\x1a\x0d\x6a\xc3\x9a\x61\x7e\x2e\xe4\x8a\x70\xa1\x21\x53\xf2\xb2\xde")
+
+func compressWith(t *testing.T, format string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch format {
+	case Gzip:
+		w = gzip.NewWriter(&buf)
+	case Zstd:
+		w, err = zstd.NewWriter(&buf)
+	case Xz:
+		w, err = xz.NewWriter(&buf)
+	case Bzip2:
+		return bzip2TestData
+	default:
+		return []byte(compressTestData)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, compressTestData); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompression(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"users.csv", ""},
+		{"users.csv.gz", Gzip},
+		{"users.CSV.GZIP", Gzip},
+		{"users.csv.zst", Zstd},
+		{"users.csv.zstd", Zstd},
+		{"users.csv.bz2", Bzip2},
+		{"users.csv.xz", Xz},
+		{"file:///data/users.csv.gz", Gzip},
+		{"s3://bucket/users.csv.zst?versionId=1", Zstd},
+		{"https://example.com/users.csv.xz#sha256=00", Xz},
+		{"https://example.com/users.gz/export", ""},
+	}
+	for _, tt := range tests {
+		if got := Compression(tt.path); got != tt.want {
+			t.Errorf("Compression(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		path   string
+	}{
+		{name: "plain", path: "users.csv"},
+		{name: "gzip", format: Gzip, path: "users.csv.gz"},
+		{name: "zstd", format: Zstd, path: "users.csv.zst"},
+		{name: "bzip2", format: Bzip2, path: "users.csv.bz2"},
+		{name: "xz", format: Xz, path: "users.csv.xz"},
+		{name: "gzip detected without extension", format: Gzip, path: "users.csv"},
+		{name: "zstd detected without extension", format: Zstd, path: "export"},
+		{name: "bzip2 detected without extension", format: Bzip2, path: "users.csv"},
+		{name: "xz detected without extension", format: Xz, path: "users.csv"},
+		{name: "gz extension but not compressed", path: "users.csv.gz"},
+		{name: "wrong compression extension", format: Zstd, path: "users.csv.gz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := decompress(bytes.NewReader(compressWith(t, tt.format)), tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != compressTestData {
+				t.Errorf("decompressed %q, want %q", got, compressTestData)
+			}
+		})
+	}
+}
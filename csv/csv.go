@@ -1,22 +1,44 @@
 package csv
 
 import (
-	"bufio"
-	"fmt"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
-	"log"
-	"os"
-	"path/filepath"
-	"reflect"
-	"strings"
 
 	dm "github.com/datamigrate/migration"
-	"github.com/schollz/progressbar/v3"
 )
 
 type Row struct {
 	Values []string
+	// Null marks the values to load as NULL. It is nil when no value is.
+	Null []bool
+	// Line is the line of the CSV file the row starts on.
+	Line int
 }
+
+// project returns the row with only the given fields, in the given order.
+func (r Row) project(fields []int) Row {
+	projected := Row{Values: make([]string, len(fields)), Line: r.Line}
+	if r.Null != nil {
+		projected.Null = make([]bool, len(fields))
+	}
+	for i, f := range fields {
+		if f < len(r.Values) {
+			projected.Values[i] = r.Values[f]
+		}
+		if projected.Null != nil {
+			projected.Null[i] = r.IsNull(f)
+		}
+	}
+	return projected
+}
+
+// IsNull reports whether the value at index i is NULL.
+func (r Row) IsNull(i int) bool {
+	return i < len(r.Null) && r.Null[i]
+}
+
 type CSV struct {
 	Path      string
 	Delimiter string
@@ -24,112 +46,132 @@ type CSV struct {
 	Rows      []Row
 }
 
-func countLines(filename string) (int, error) {
-	file, err := os.Open(filename)
+// CountRows returns the number of data rows in the CSV file, not counting the
+// header and empty lines. A relative path is read from opts.FS when it is set.
+func CountRows(ctx context.Context, path string, dialect Dialect, opts Options) (int, error) {
+	file, _, _, err := openSource(ctx, path, opts.FS)
 	if err != nil {
 		return 0, err
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	lineCount := 0
-	for scanner.Scan() {
-		lineCount++
+	body, err := decompress(file, path)
+	if err != nil {
+		return 0, err
 	}
+	defer body.Close()
 
-	if err := scanner.Err(); err != nil {
-		return 0, err
+	reader := NewReader(body, path, dialect)
+	rows := 0
+	for {
+		_, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		rows++
 	}
 
-	return lineCount, nil
+	// the first record is the header
+	if rows > 0 {
+		rows--
+	}
+	return rows, nil
 }
 
-func LoadCSV(path string, delimiter string) (*CSV, error) {
-	// Load CSV file
-
-	// get the abspath relative the cwd
-	absPath, err := filepath.Abs(path)
-	if err != nil {
-		return nil, fmt.Errorf("an error occurred while getting the absolute path of the csv file: %v", err)
-	}
-	log.Println("Loading csv from path: ", absPath)
-	file, err := os.Open(absPath)
+// Checksum returns the hex encoded SHA-256 of the file or object at path,
+// read from opts.FS when it is relative and opts.FS is set.
+func Checksum(ctx context.Context, path string, opts Options) (string, error) {
+	file, _, _, err := openSource(ctx, path, opts.FS)
 	if err != nil {
-		return nil, fmt.Errorf("an error occurred while opening the file: %v", err)
+		return "", err
 	}
 	defer file.Close()
 
-	totalLines, err := countLines(absPath)
-	if err != nil {
-		return nil, fmt.Errorf("an error occurred while counting the lines in the file: %v", err)
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
 	}
-	bar := progressbar.Default(int64(totalLines), "Loading CSV from path: "+path)
-
-	reader := bufio.NewReader(file)
-	index := 0
-
-	var csvFile CSV
-	csvFile.Path = absPath
-	csvFile.Delimiter = delimiter
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
 
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("an error occurred while reading the file: %v", err)
-		}
+// LoadCSV reads the whole CSV file at path into memory. The first record is
+// the header. Use OpenCSV to stream large files instead.
+func LoadCSV(ctx context.Context, path string, dialect Dialect) (*CSV, error) {
+	s, err := OpenCSV(ctx, path, dialect, Options{})
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
 
-		// trim the line to remove any trailing newline characters
-		line = strings.TrimSpace(line)
+	csvFile := CSV{
+		Path:      s.Path,
+		Delimiter: string(dialect.withDefaults().Delimiter),
+		Columns:   s.Columns,
+	}
+	for s.Next() {
+		csvFile.Rows = append(csvFile.Rows, s.Row())
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
 
-		// skip empty lines
-		if line == "" {
-			if err == io.EOF {
-				break
-			}
-			continue
-		}
+	return &csvFile, nil
+}
 
-		if index == 0 {
-			// if it's the first line, then it's the header
-			columns := strings.Split(line, delimiter)
-			// trim the columns
-			for i, col := range columns {
-				columns[i] = strings.TrimSpace(col)
-			}
-			csvFile.Columns = columns
-		} else {
-			// create a row and append it to the rows
-			row := Row{}
-			row.Values = strings.Split(line, delimiter)
-
-			// if the row isn't empty, then append it
-			if len(row.Values) > 0 {
-				csvFile.Rows = append(csvFile.Rows, row)
-			}
+// NullMarkers returns the null marker of each of the given CSV columns, as
+// configured in the data migration.
+func NullMarkers(header []string, m *dm.MigrationDDL) []*string {
+	markers := make([]*string, len(header))
+	for i, h := range header {
+		markers[i] = m.Null
+		if col, ok := m.ColumnByHeader(h); ok {
+			markers[i] = m.NullMarker(col.Name)
 		}
+	}
+	return markers
+}
 
-		index++
-		bar.Add(1)
+// Mapping maps the fields of a CSV file to the table columns they are loaded
+// into.
+type Mapping struct {
+	// Columns are the table columns, in load order.
+	Columns []string
+	// Fields holds the index of the CSV field loaded into each column.
+	Fields []int
+}
 
-		if err == io.EOF {
-			break
+// MapColumns maps the CSV header to the columns of the data migration. The
+// CSV may order its columns freely and have columns the migration does not
+// load. Table columns missing from the migration get their default value.
+func MapColumns(header []string, m *dm.MigrationDDL) (*Mapping, error) {
+	fields := make(map[string]int, len(header))
+	for i, h := range header {
+		if _, ok := fields[h]; !ok {
+			fields[h] = i
 		}
 	}
 
-	return &csvFile, nil
-}
-
-func ValidateColumns(c *CSV, m *dm.MigrationDDL) error {
-	// check the column order to match the migration
-	migrationNames := []string{}
+	var mapping Mapping
+	var missing []string
 	for _, col := range m.Columns {
-		migrationNames = append(migrationNames, col.Name)
+		i, ok := fields[col.Header()]
+		if !ok {
+			missing = append(missing, col.Header())
+			continue
+		}
+		mapping.Columns = append(mapping.Columns, col.Name)
+		mapping.Fields = append(mapping.Fields, i)
 	}
-
-	areEqual := reflect.DeepEqual(c.Columns, migrationNames)
-	if !areEqual {
-		return fmt.Errorf("CSV Columns are not equal to columns in the original migration. CSV Columns: %v, Migration Columns: %v", c.Columns, migrationNames)
+	if len(missing) > 0 {
+		migrationNames := []string{}
+		for _, col := range m.Columns {
+			migrationNames = append(migrationNames, col.Header())
+		}
+		return nil, &dm.ColumnMismatchError{CSVColumns: header, MigrationColumns: migrationNames, Missing: missing}
 	}
 
-	return nil
+	return &mapping, nil
 }
@@ -0,0 +1,99 @@
+package csv
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	dm "github.com/datamigrate/migration"
+)
+
+func TestMapColumns(t *testing.T) {
+	m := &dm.MigrationDDL{Columns: []dm.Column{
+		{Name: "id"},
+		{Name: "email", CSV: "E-mail"},
+		{Name: "name"},
+	}}
+	tests := []struct {
+		name    string
+		header  []string
+		want    *Mapping
+		missing []string
+	}{
+		{
+			name:   "same order",
+			header: []string{"id", "E-mail", "name"},
+			want:   &Mapping{Columns: []string{"id", "email", "name"}, Fields: []int{0, 1, 2}},
+		},
+		{
+			name:   "reordered with extra columns",
+			header: []string{"name", "unused", "E-mail", "id"},
+			want:   &Mapping{Columns: []string{"id", "email", "name"}, Fields: []int{3, 2, 0}},
+		},
+		{
+			name:   "duplicate header uses the first",
+			header: []string{"id", "id", "E-mail", "name"},
+			want:   &Mapping{Columns: []string{"id", "email", "name"}, Fields: []int{0, 2, 3}},
+		},
+		{
+			name:    "missing columns",
+			header:  []string{"id", "email"},
+			missing: []string{"E-mail", "name"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MapColumns(tt.header, m)
+			if tt.missing != nil {
+				var mismatch *dm.ColumnMismatchError
+				if !errors.As(err, &mismatch) || !errors.Is(err, dm.ErrColumnMismatch) {
+					t.Fatalf("err = %v, want a *dm.ColumnMismatchError", err)
+				}
+				if !reflect.DeepEqual(mismatch.Missing, tt.missing) {
+					t.Errorf("missing = %q, want %q", mismatch.Missing, tt.missing)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MapColumns = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenFromFS(t *testing.T) {
+	fsys := fstest.MapFS{"seeds/users.csv": {Data: []byte("id,name\n1,ann\n")}}
+	m := &dm.MigrationDDL{CSVPath: "seeds/users.csv", FS: fsys}
+
+	s, err := Open(context.Background(), m, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var rows [][]string
+	for s.Next() {
+		rows = append(rows, s.Row().Values)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"1", "ann"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+
+	sum, err := Checksum(context.Background(), m.CSVPath, Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != s.Checksum() {
+		t.Errorf("Checksum = %s, want the checksum of the stream %s", sum, s.Checksum())
+	}
+	if err := Exists(context.Background(), "seeds/missing.csv", Options{FS: fsys}); !errors.Is(err, dm.ErrMissingCSV) {
+		t.Errorf("Exists(missing) = %v, want dm.ErrMissingCSV", err)
+	}
+}
@@ -0,0 +1,376 @@
+package csv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	dm "github.com/datamigrate/migration"
+)
+
+// Errors reported by the JSONReader, wrapped in a *ParseError.
+var (
+	ErrNotObject  = errors.New("expected a JSON object")
+	ErrMissingKey = errors.New("missing key")
+)
+
+// JSONReader reads records from a JSON array of objects, or from
+// newline-delimited JSON. Each object is read as a record holding the values
+// of the given keys, in order. A key can be a dotted path such as
+// address.city to read a value of a nested object. JSON nulls are NULL;
+// nested objects and arrays are read as JSON text. An object missing one of
+// the keys is returned with an error wrapping ErrMissingKey, so that it can be
+// rejected.
+type JSONReader struct {
+	// Raw marks the keys whose values are read as JSON text, strings
+	// included, e.g. the ones loaded into json and jsonb columns.
+	Raw []bool
+
+	path  string
+	keys  []string
+	lines bool
+
+	dec     *json.Decoder
+	counter *lineCounter
+	started bool
+
+	// the last object read: its position, values, and which were null or
+	// strings
+	line     int
+	col      int
+	record   []string
+	null     []bool
+	isString []bool
+}
+
+// NewJSONReader returns a JSONReader reading from r, which holds a JSON array
+// of objects, or one object per line when lines is set. The path is only used
+// in errors.
+func NewJSONReader(r io.Reader, path string, keys []string, lines bool) *JSONReader {
+	counter := &lineCounter{r: r, line: 1}
+	dec := json.NewDecoder(counter)
+	dec.UseNumber()
+	return &JSONReader{path: path, keys: keys, lines: lines, dec: dec, counter: counter}
+}
+
+// Line returns the line the last object read started on.
+func (r *JSONReader) Line() int {
+	return r.line
+}
+
+// FieldPos returns the position of the last object read: JSON values are not
+// located individually.
+func (r *JSONReader) FieldPos(field int) (line int, column int) {
+	return r.line, r.col
+}
+
+// FieldNull reports whether the given field of the last object read is NULL:
+// it is a JSON null or a string equal to the null marker.
+func (r *JSONReader) FieldNull(field int, marker *string) bool {
+	if field < 0 || field >= len(r.record) {
+		return false
+	}
+	return r.null[field] || (marker != nil && r.isString[field] && r.record[field] == *marker)
+}
+
+// Read reads the next object. It returns io.EOF when there are no more
+// objects. An object missing some of the keys is returned along with an error.
+func (r *JSONReader) Read() ([]string, error) {
+	if !r.started {
+		r.started = true
+		if !r.lines {
+			if err := r.openArray(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !r.dec.More() {
+		return nil, r.end()
+	}
+
+	// the raw object locates it: it ends where the decoder stopped
+	var raw json.RawMessage
+	if err := r.dec.Decode(&raw); err != nil {
+		return nil, r.parseError(err)
+	}
+	r.line, r.col = r.counter.pos(r.dec.InputOffset() - int64(len(raw)))
+	var value any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil, r.parseError(err)
+	}
+	obj, ok := value.(map[string]any)
+	if !ok {
+		return nil, &ParseError{Path: r.path, Line: r.line, Column: r.col, Err: fmt.Errorf("%w, got %s", ErrNotObject, jsonKind(value))}
+	}
+
+	record := make([]string, len(r.keys))
+	r.null = r.null[:0]
+	r.isString = r.isString[:0]
+	var missing []string
+	for i, key := range r.keys {
+		v, ok := lookupKey(obj, key)
+		if !ok {
+			missing = append(missing, key)
+		}
+		raw := i < len(r.Raw) && r.Raw[i]
+		text, err := jsonText(v, raw)
+		if err != nil {
+			return nil, &ParseError{Path: r.path, Line: r.line, Column: r.col, Err: err}
+		}
+		_, isString := v.(string)
+		record[i] = text
+		r.null = append(r.null, v == nil)
+		r.isString = append(r.isString, isString && !raw)
+	}
+	r.record = record
+	if len(missing) > 0 {
+		return record, &ParseError{Path: r.path, Line: r.line, Column: r.col, Err: fmt.Errorf("%w: %s", ErrMissingKey, strings.Join(missing, ", "))}
+	}
+	return record, nil
+}
+
+// openArray reads the opening bracket of the array of objects.
+func (r *JSONReader) openArray() error {
+	tok, err := r.dec.Token()
+	if err == io.EOF {
+		return fmt.Errorf("the json file %s is empty", r.path)
+	}
+	if err != nil {
+		return r.parseError(err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		line, col := r.counter.pos(r.dec.InputOffset())
+		return &ParseError{Path: r.path, Line: line, Column: col, Err: errors.New("expected a JSON array of objects, use the ndjson format for one object per line")}
+	}
+	return nil
+}
+
+// end checks that nothing follows the last object and returns io.EOF.
+func (r *JSONReader) end() error {
+	if !r.lines {
+		// the closing bracket of the array
+		if _, err := r.dec.Token(); err != nil {
+			return r.parseError(err)
+		}
+	}
+	tok, err := r.dec.Token()
+	if err == io.EOF {
+		return io.EOF
+	}
+	if err != nil {
+		return r.parseError(err)
+	}
+	line, col := r.counter.pos(r.dec.InputOffset())
+	return &ParseError{Path: r.path, Line: line, Column: col, Err: fmt.Errorf("unexpected %v after the last object", tok)}
+}
+
+func (r *JSONReader) parseError(err error) error {
+	line, col := r.line, r.col
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line, col = r.counter.pos(syntaxErr.Offset)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &ParseError{Path: r.path, Line: line, Column: col, Err: err}
+}
+
+// lookupKey returns the value of key in obj. A key that is not in obj is
+// looked up as a dotted path through the nested objects.
+func lookupKey(obj map[string]any, key string) (any, bool) {
+	if v, ok := obj[key]; ok {
+		return v, true
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] != '.' {
+			continue
+		}
+		if nested, ok := obj[key[:i]].(map[string]any); ok {
+			if v, ok := lookupKey(nested, key[i+1:]); ok {
+				return v, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// jsonText returns the text a JSON value is loaded as: strings as is, unless
+// raw, numbers and booleans as written, and objects and arrays as JSON.
+func jsonText(v any, raw bool) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		if !raw {
+			return v, nil
+		}
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "true", nil
+		}
+		return "false", nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+func jsonKind(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case json.Number:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []any:
+		return "an array"
+	}
+	return "an object"
+}
+
+// lineCounter counts the lines of the input read through it, to find the
+// line and column of an offset already read.
+type lineCounter struct {
+	r    io.Reader
+	read int64
+	// offsets of the newlines after the last position asked for
+	newlines  []int64
+	line      int
+	lineStart int64
+}
+
+func (c *lineCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for i, b := range p[:n] {
+		if b == '\n' {
+			c.newlines = append(c.newlines, c.read+int64(i))
+		}
+	}
+	c.read += int64(n)
+	return n, err
+}
+
+// pos returns the line and column of offset. Offsets are asked for in
+// increasing order.
+func (c *lineCounter) pos(offset int64) (int, int) {
+	for len(c.newlines) > 0 && c.newlines[0] < offset {
+		c.line++
+		c.lineStart = c.newlines[0] + 1
+		c.newlines = c.newlines[1:]
+	}
+	return c.line, int(offset-c.lineStart) + 1
+}
+
+// OpenJSON opens the JSON array of objects, or the newline-delimited JSON
+// when lines is set, at path. The columns of the stream are the keys read
+// from every object.
+func OpenJSON(ctx context.Context, path string, keys []string, lines bool, opts Options) (*Stream, error) {
+	s, err := openStream(ctx, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.reader = NewJSONReader(s.body, path, keys, lines)
+	s.Columns = keys
+	return s, nil
+}
+
+// Open opens the file of a data migration in its format, see OpenCSV and
+// OpenJSON. The keys of JSON objects are the headers of the migration
+// columns. A relative path is read from the FS of the data migration, unless
+// opts has one.
+func Open(ctx context.Context, m *dm.MigrationDDL, opts Options) (*Stream, error) {
+	if opts.FS == nil {
+		opts.FS = m.FS
+	}
+	format, err := m.DataFormat()
+	if err != nil {
+		return nil, err
+	}
+	if format == dm.FormatCSV {
+		dialect, err := DialectFor(m)
+		if err != nil {
+			return nil, err
+		}
+		return OpenCSV(ctx, m.CSVPath, dialect, opts)
+	}
+	s, err := OpenJSON(ctx, m.CSVPath, jsonKeys(m), format == dm.FormatNDJSON, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.reader.(*JSONReader).Raw = jsonRaw(m)
+	return s, nil
+}
+
+// CountRecords returns the number of rows in the file of a data migration,
+// without its header.
+func CountRecords(ctx context.Context, m *dm.MigrationDDL) (int, error) {
+	format, err := m.DataFormat()
+	if err != nil {
+		return 0, err
+	}
+	if format == dm.FormatCSV {
+		dialect, err := DialectFor(m)
+		if err != nil {
+			return 0, err
+		}
+		return CountRows(ctx, m.CSVPath, dialect, Options{FS: m.FS})
+	}
+
+	file, _, _, err := openSource(ctx, m.CSVPath, m.FS)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	body, err := decompress(file, m.CSVPath)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	reader := NewJSONReader(body, m.CSVPath, nil, format == dm.FormatNDJSON)
+	rows := 0
+	for {
+		_, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		rows++
+	}
+}
+
+// jsonRaw marks the columns of json and jsonb type, whose values are loaded as
+// JSON text.
+func jsonRaw(m *dm.MigrationDDL) []bool {
+	raw := make([]bool, len(m.Columns))
+	for i, col := range m.Columns {
+		raw[i] = parseColumnType(col.Type).kind == kindJSON
+	}
+	return raw
+}
+
+func jsonKeys(m *dm.MigrationDDL) []string {
+	keys := make([]string, len(m.Columns))
+	for i, col := range m.Columns {
+		keys[i] = col.Header()
+	}
+	return keys
+}
@@ -0,0 +1,80 @@
+package csv
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	dm "github.com/datamigrate/migration"
+)
+
+func TestOpenJSONRejectsMissingKeys(t *testing.T) {
+	data := `{"id": 1, "name": "ann", "tags": "vip"}
+{"id": 2, "tags": ["a", "b"]}
+{"id": 3, "name": null, "tags": null}
+`
+	fsys := fstest.MapFS{"users.ndjson": {Data: []byte(data)}}
+	m := &dm.MigrationDDL{CSVPath: "users.ndjson", FileFormat: dm.FormatNDJSON, FS: fsys, Columns: []dm.Column{
+		{Name: "id", Type: "int"},
+		{Name: "name", Type: "text"},
+		{Name: "tags", Type: "jsonb"},
+	}}
+
+	s, err := Open(context.Background(), m, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Converter = NewConverter(m.CSVPath, []string{"id", "name", "tags"}, m)
+	var rejected []error
+	s.OnReject = func(row Row, err error) error {
+		rejected = append(rejected, err)
+		return nil
+	}
+	var rows [][]string
+	var nulls [][]bool
+	for s.Next() {
+		rows = append(rows, s.Row().Values)
+		nulls = append(nulls, s.Row().Null)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a JSON string stays quoted in a jsonb column
+	if want := [][]string{{"1", "ann", `"vip"`}, {"3", "", ""}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+	if want := [][]bool{{false, false, false}, {false, true, true}}; !reflect.DeepEqual(nulls, want) {
+		t.Errorf("nulls = %v, want %v", nulls, want)
+	}
+	if len(rejected) != 1 || !errors.Is(rejected[0], ErrMissingKey) || !errors.Is(rejected[0], dm.ErrParse) {
+		t.Fatalf("rejected = %v, want one ErrMissingKey", rejected)
+	}
+	var parseErr *ParseError
+	if !errors.As(rejected[0], &parseErr) || parseErr.Line != 2 {
+		t.Errorf("rejected = %v, want a *ParseError on line 2", rejected[0])
+	}
+}
+
+func TestOpenJSONFailsOnMissingKeysWithoutOnReject(t *testing.T) {
+	fsys := fstest.MapFS{"users.json": {Data: []byte(`[{"id": 1}]`)}}
+	m := &dm.MigrationDDL{CSVPath: "users.json", FileFormat: dm.FormatJSON, FS: fsys, Columns: []dm.Column{
+		{Name: "id", Type: "int"},
+		{Name: "city", Type: "text", CSV: "address.city"},
+	}}
+
+	s, err := Open(context.Background(), m, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for s.Next() {
+		t.Errorf("unexpected row %q", s.Row().Values)
+	}
+	if err := s.Err(); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("err = %v, want ErrMissingKey", err)
+	}
+}
@@ -0,0 +1,326 @@
+package csv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	dm "github.com/datamigrate/migration"
+)
+
+// Errors reported by the Reader, wrapped in a *ParseError.
+var (
+	ErrBareQuote      = errors.New("bare quote in non-quoted field")
+	ErrQuote          = errors.New("extraneous or missing quote in quoted field")
+	ErrUnterminated   = errors.New("unterminated quoted field")
+	ErrInvalidDialect = errors.New("invalid csv dialect")
+	ErrFieldCount     = errors.New("wrong number of fields")
+	errTrailingEscape = errors.New("escape character at end of input")
+)
+
+const (
+	defaultDelimiter = ','
+	defaultQuote     = '"'
+	noEscape         = rune(0)
+)
+
+// Dialect describes how a CSV file is written. The zero value is RFC 4180:
+// comma separated, fields quoted with double quotes and quotes escaped by
+// doubling them.
+type Dialect struct {
+	Delimiter rune
+	// Quote encloses fields containing delimiters, quotes or newlines.
+	Quote rune
+	// Escape makes the next character literal inside a quoted field. When it
+	// is zero or equal to Quote, a quote is escaped by doubling it.
+	Escape rune
+}
+
+// DialectFor returns the dialect configured in a data migration.
+func DialectFor(m *dm.MigrationDDL) (Dialect, error) {
+	var d Dialect
+	var err error
+	if d.Delimiter, err = singleRune("delimiter", m.Delimiter); err != nil {
+		return d, err
+	}
+	if d.Quote, err = singleRune("quote", m.Quote); err != nil {
+		return d, err
+	}
+	if d.Escape, err = singleRune("escape", m.Escape); err != nil {
+		return d, err
+	}
+	return d.withDefaults(), nil
+}
+
+func singleRune(name string, s string) (rune, error) {
+	if s == "" {
+		return 0, nil
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size != len(s) || r == utf8.RuneError {
+		return 0, fmt.Errorf("%w: the %s must be a single character, got %q", ErrInvalidDialect, name, s)
+	}
+	return r, nil
+}
+
+func (d Dialect) withDefaults() Dialect {
+	if d.Delimiter == 0 {
+		d.Delimiter = defaultDelimiter
+	}
+	if d.Quote == 0 {
+		d.Quote = defaultQuote
+	}
+	if d.Escape == d.Quote {
+		d.Escape = noEscape
+	}
+	return d
+}
+
+// ParseError is returned for malformed CSV input. Line and Column are 1-based
+// and point at the character where the problem was found.
+type ParseError struct {
+	Path   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %v", e.Path, e.Line, e.Column, e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+func (e *ParseError) Is(target error) bool { return target == dm.ErrParse }
+
+// Reader reads records from RFC 4180 CSV input. Quoted fields may contain
+// delimiters, escaped quotes and newlines. Empty lines are skipped.
+type Reader struct {
+	dialect Dialect
+	path    string
+	r       *bufio.Reader
+
+	// position of the next rune to be read
+	line int
+	col  int
+	// position before the last rune read, to support unread
+	prevLine int
+	prevCol  int
+
+	record      []string
+	fieldPos    [][2]int
+	fieldQuoted []bool
+}
+
+// NewReader returns a Reader reading from r. The path is only used in errors.
+func NewReader(r io.Reader, path string, dialect Dialect) *Reader {
+	return &Reader{
+		dialect: dialect.withDefaults(),
+		path:    path,
+		r:       bufio.NewReader(r),
+		line:    1,
+		col:     1,
+	}
+}
+
+// Line returns the line the last record read started on.
+func (r *Reader) Line() int {
+	if len(r.fieldPos) == 0 {
+		return 0
+	}
+	return r.fieldPos[0][0]
+}
+
+// FieldPos returns the line and column at which the given field of the last
+// record read starts.
+func (r *Reader) FieldPos(field int) (line int, column int) {
+	if field < 0 || field >= len(r.fieldPos) {
+		return 0, 0
+	}
+	return r.fieldPos[field][0], r.fieldPos[field][1]
+}
+
+// FieldQuoted reports whether the given field of the last record read was
+// enclosed in quotes.
+func (r *Reader) FieldQuoted(field int) bool {
+	if field < 0 || field >= len(r.fieldQuoted) {
+		return false
+	}
+	return r.fieldQuoted[field]
+}
+
+// FieldNull reports whether the given field of the last record read is NULL
+// for the null marker of its column. Like PostgreSQL's COPY, a quoted field is
+// never NULL, so "" can still load an empty string.
+func (r *Reader) FieldNull(field int, marker *string) bool {
+	if marker == nil || field < 0 || field >= len(r.record) {
+		return false
+	}
+	return r.record[field] == *marker && !r.FieldQuoted(field)
+}
+
+// Read reads the next record. It returns io.EOF when there are no more records.
+func (r *Reader) Read() ([]string, error) {
+	// skip empty lines
+	for {
+		c, err := r.readRune()
+		if err != nil {
+			return nil, err
+		}
+		if c != '\n' && c != '\r' {
+			r.unreadRune()
+			break
+		}
+	}
+
+	r.fieldPos = r.fieldPos[:0]
+	r.fieldQuoted = r.fieldQuoted[:0]
+	var record []string
+	for {
+		r.fieldPos = append(r.fieldPos, [2]int{r.line, r.col})
+		r.fieldQuoted = append(r.fieldQuoted, false)
+		field, end, err := r.readField()
+		if err != nil {
+			return nil, err
+		}
+		record = append(record, field)
+		if end {
+			r.record = record
+			return record, nil
+		}
+	}
+}
+
+// readField reads a single field and reports whether it was the last field
+// of the record.
+func (r *Reader) readField() (string, bool, error) {
+	c, err := r.readRune()
+	if err == io.EOF {
+		return "", true, nil
+	}
+	if err != nil {
+		return "", true, err
+	}
+	if c == r.dialect.Quote {
+		r.fieldQuoted[len(r.fieldQuoted)-1] = true
+		return r.readQuotedField()
+	}
+	r.unreadRune()
+
+	var field strings.Builder
+	for {
+		c, err := r.readRune()
+		if err == io.EOF {
+			return field.String(), true, nil
+		}
+		if err != nil {
+			return "", true, err
+		}
+		switch c {
+		case r.dialect.Delimiter:
+			return field.String(), false, nil
+		case '\n':
+			return field.String(), true, nil
+		case '\r':
+			if r.endOfLine() {
+				return field.String(), true, nil
+			}
+		case r.dialect.Quote:
+			return "", true, r.errorAt(r.prevLine, r.prevCol, ErrBareQuote)
+		}
+		field.WriteRune(c)
+	}
+}
+
+func (r *Reader) readQuotedField() (string, bool, error) {
+	startLine, startCol := r.prevLine, r.prevCol
+	var field strings.Builder
+	for {
+		c, err := r.readRune()
+		if err == io.EOF {
+			return "", true, r.errorAt(startLine, startCol, ErrUnterminated)
+		}
+		if err != nil {
+			return "", true, err
+		}
+
+		switch {
+		case r.dialect.Escape != noEscape && c == r.dialect.Escape:
+			next, err := r.readRune()
+			if err == io.EOF {
+				return "", true, r.errorAt(r.line, r.col, errTrailingEscape)
+			}
+			if err != nil {
+				return "", true, err
+			}
+			field.WriteRune(next)
+		case c == r.dialect.Quote:
+			next, err := r.readRune()
+			if err == io.EOF {
+				return field.String(), true, nil
+			}
+			if err != nil {
+				return "", true, err
+			}
+			switch {
+			case next == r.dialect.Quote && r.dialect.Escape == noEscape:
+				// a doubled quote is a literal quote
+				field.WriteRune(next)
+			case next == r.dialect.Delimiter:
+				return field.String(), false, nil
+			case next == '\n':
+				return field.String(), true, nil
+			case next == '\r' && r.endOfLine():
+				return field.String(), true, nil
+			default:
+				return "", true, r.errorAt(r.prevLine, r.prevCol, ErrQuote)
+			}
+		default:
+			field.WriteRune(c)
+		}
+	}
+}
+
+// endOfLine is called after a '\r' and reports whether it ends the line,
+// consuming the '\n' of a "\r\n" pair.
+func (r *Reader) endOfLine() bool {
+	next, err := r.readRune()
+	if err == io.EOF {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	if next == '\n' {
+		return true
+	}
+	r.unreadRune()
+	return false
+}
+
+func (r *Reader) readRune() (rune, error) {
+	c, _, err := r.r.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	r.prevLine, r.prevCol = r.line, r.col
+	if c == '\n' {
+		r.line++
+		r.col = 1
+	} else {
+		r.col++
+	}
+	return c, nil
+}
+
+func (r *Reader) unreadRune() {
+	r.r.UnreadRune()
+	r.line, r.col = r.prevLine, r.prevCol
+}
+
+func (r *Reader) errorAt(line int, col int, err error) error {
+	return &ParseError{Path: r.path, Line: line, Column: col, Err: err}
+}
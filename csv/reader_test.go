@@ -0,0 +1,228 @@
+package csv
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	dm "github.com/datamigrate/migration"
+)
+
+// readAll reads every record of input, with the line each one starts on.
+func readAll(input string, dialect Dialect) ([][]string, []int, error) {
+	r := NewReader(strings.NewReader(input), "test.csv", dialect)
+	var records [][]string
+	var lines []int
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return records, lines, nil
+		}
+		if err != nil {
+			return records, lines, err
+		}
+		records = append(records, record)
+		lines = append(lines, r.Line())
+	}
+}
+
+func TestReaderRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		dialect Dialect
+		want    [][]string
+		lines   []int
+	}{
+		{
+			name:  "simple",
+			input: "a,b\n1,2\n",
+			want:  [][]string{{"a", "b"}, {"1", "2"}},
+			lines: []int{1, 2},
+		},
+		{
+			name:  "no final newline",
+			input: "a,b\n1,2",
+			want:  [][]string{{"a", "b"}, {"1", "2"}},
+			lines: []int{1, 2},
+		},
+		{
+			name:  "quoted delimiter",
+			input: "\"a,b\",c\n",
+			want:  [][]string{{"a,b", "c"}},
+			lines: []int{1},
+		},
+		{
+			name:  "doubled quotes",
+			input: "\"say \"\"hi\"\"\",x\n",
+			want:  [][]string{{"say \"hi\"", "x"}},
+			lines: []int{1},
+		},
+		{
+			name:  "embedded newline",
+			input: "\"line1\nline2\",x\ny,z\n",
+			want:  [][]string{{"line1\nline2", "x"}, {"y", "z"}},
+			lines: []int{1, 3},
+		},
+		{
+			name:  "crlf",
+			input: "a,b\r\n\"c\",d\r\n",
+			want:  [][]string{{"a", "b"}, {"c", "d"}},
+			lines: []int{1, 2},
+		},
+		{
+			name:  "bare carriage return in a field",
+			input: "a\rb,c\n",
+			want:  [][]string{{"a\rb", "c"}},
+			lines: []int{1},
+		},
+		{
+			name:  "trailing delimiter",
+			input: "a,b,\n1,2,\n",
+			want:  [][]string{{"a", "b", ""}, {"1", "2", ""}},
+			lines: []int{1, 2},
+		},
+		{
+			name:  "empty lines",
+			input: "\n\na,b\n\n\r\n1,2\n\n",
+			want:  [][]string{{"a", "b"}, {"1", "2"}},
+			lines: []int{3, 6},
+		},
+		{
+			name:  "empty quoted field",
+			input: "\"\",x\n",
+			want:  [][]string{{"", "x"}},
+			lines: []int{1},
+		},
+		{
+			name:    "custom escape",
+			input:   "\"a\\\"b\",\"c\\\\d\"\n",
+			dialect: Dialect{Escape: '\\'},
+			want:    [][]string{{"a\"b", "c\\d"}},
+			lines:   []int{1},
+		},
+		{
+			name:    "custom delimiter and quote",
+			input:   "'a;b';c\n",
+			dialect: Dialect{Delimiter: ';', Quote: '\''},
+			want:    [][]string{{"a;b", "c"}},
+			lines:   []int{1},
+		},
+		{
+			name:    "escape equal to quote doubles quotes",
+			input:   "\"a\"\"b\"\n",
+			dialect: Dialect{Escape: '"'},
+			want:    [][]string{{"a\"b"}},
+			lines:   []int{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, lines, err := readAll(tt.input, tt.dialect)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("records = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(lines, tt.lines) {
+				t.Errorf("lines = %v, want %v", lines, tt.lines)
+			}
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		dialect Dialect
+		err     error
+		line    int
+		column  int
+	}{
+		{name: "bare quote", input: "a\"b,c\n", err: ErrBareQuote, line: 1, column: 2},
+		{name: "text after closing quote", input: "\"a\"b,c\n", err: ErrQuote, line: 1, column: 4},
+		{name: "unterminated", input: "x,\"abc\n", err: ErrUnterminated, line: 1, column: 3},
+		{name: "on a later line", input: "a,b\nc,\"d\"e\n", err: ErrQuote, line: 2, column: 6},
+		{name: "after a multiline field", input: "\"a\nb\",c\nd\"\n", err: ErrBareQuote, line: 3, column: 2},
+		{name: "trailing escape", input: "\"a\\", dialect: Dialect{Escape: '\\'}, err: errTrailingEscape, line: 1, column: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readAll(tt.input, tt.dialect)
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("err = %v, want a *ParseError", err)
+			}
+			if !errors.Is(err, tt.err) || !errors.Is(err, dm.ErrParse) {
+				t.Errorf("err = %v, want %v and dm.ErrParse", err, tt.err)
+			}
+			if parseErr.Line != tt.line || parseErr.Column != tt.column {
+				t.Errorf("position = %d:%d, want %d:%d", parseErr.Line, parseErr.Column, tt.line, tt.column)
+			}
+			if parseErr.Path != "test.csv" {
+				t.Errorf("path = %q, want test.csv", parseErr.Path)
+			}
+		})
+	}
+}
+
+func TestReaderFieldPosAndQuoted(t *testing.T) {
+	r := NewReader(strings.NewReader("a,\"bb\",c\n"), "test.csv", Dialect{})
+	if _, err := r.Read(); err != nil {
+		t.Fatal(err)
+	}
+	wantPos := [][2]int{{1, 1}, {1, 3}, {1, 8}}
+	for i, want := range wantPos {
+		if line, col := r.FieldPos(i); line != want[0] || col != want[1] {
+			t.Errorf("FieldPos(%d) = %d:%d, want %d:%d", i, line, col, want[0], want[1])
+		}
+	}
+	wantQuoted := []bool{false, true, false}
+	for i, want := range wantQuoted {
+		if got := r.FieldQuoted(i); got != want {
+			t.Errorf("FieldQuoted(%d) = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestReaderFieldNull(t *testing.T) {
+	null := `\N`
+	empty := ""
+	r := NewReader(strings.NewReader("\\N,\"\\N\",,\"\"\n"), "test.csv", Dialect{})
+	if _, err := r.Read(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		field  int
+		marker *string
+		want   bool
+	}{
+		{0, &null, true},
+		{0, nil, false},
+		{1, &null, false}, // quoted fields are never NULL
+		{2, &empty, true},
+		{3, &empty, false},
+	}
+	for _, tt := range tests {
+		if got := r.FieldNull(tt.field, tt.marker); got != tt.want {
+			t.Errorf("FieldNull(%d) = %v, want %v", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestDialectFor(t *testing.T) {
+	d, err := DialectFor(&dm.MigrationDDL{Delimiter: ";", Escape: "\\"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Dialect{Delimiter: ';', Quote: '"', Escape: '\\'}); d != want {
+		t.Errorf("DialectFor = %+v, want %+v", d, want)
+	}
+	if _, err := DialectFor(&dm.MigrationDDL{Delimiter: ";;"}); !errors.Is(err, ErrInvalidDialect) {
+		t.Errorf("err = %v, want ErrInvalidDialect", err)
+	}
+}
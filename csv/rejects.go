@@ -0,0 +1,90 @@
+package csv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// RejectsPath returns the path of the rejects file of the CSV file at p,
+// e.g. data/users.rejects.csv for data/users.csv or data/users.csv.gz. The
+// rejects of a CSV read from a URL, such as an s3:// object, or from
+// opts.FS, which may not exist on disk, are written to the current directory.
+func RejectsPath(p string, opts Options) string {
+	if local, ok := strings.CutPrefix(p, "file://"); ok {
+		p = local
+	} else if _, scheme, err := sourceIn(p, opts.FS); err == nil && scheme == "fs" {
+		p = path.Base(p)
+	} else {
+		p = localName(p)
+	}
+	if Compression(p) != "" {
+		p = strings.TrimSuffix(p, filepath.Ext(p))
+	}
+	return strings.TrimSuffix(p, filepath.Ext(p)) + ".rejects.csv"
+}
+
+// Rejects writes rejected rows, with the line they were read from and the
+// reason they were rejected, to a CSV file in the dialect of the source.
+// The file is only created once the first row is rejected.
+type Rejects struct {
+	Path  string
+	Count int64
+
+	header  []string
+	dialect Dialect
+	file    *os.File
+	w       *Writer
+}
+
+// NewRejects returns a Rejects for the CSV file with the given header, read
+// with opts. A rejects file left over by a previous run is removed.
+func NewRejects(path string, header []string, dialect Dialect, opts Options) (*Rejects, error) {
+	r := &Rejects{Path: RejectsPath(path, opts), header: header, dialect: dialect}
+	err := os.Remove(r.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("an error occurred while removing the rejects file %s: %w", r.Path, err)
+	}
+	return r, nil
+}
+
+// Reject writes a rejected row. It can be used as a Stream's OnReject.
+func (r *Rejects) Reject(row Row, reason error) error {
+	if r.file == nil {
+		file, err := os.Create(r.Path)
+		if err != nil {
+			return fmt.Errorf("an error occurred while creating the rejects file %s: %w", r.Path, err)
+		}
+		r.file = file
+		r.w = NewWriter(file, r.dialect)
+		header := append(append([]string{}, r.header...), "rejected_line", "rejected_reason")
+		if err := r.w.Write(header); err != nil {
+			return err
+		}
+	}
+
+	r.Count++
+	record := append([]string{}, row.Values...)
+	// pad short rows so that the line and reason stay in their columns
+	for len(record) < len(r.header) {
+		record = append(record, "")
+	}
+	record = append(record, strconv.Itoa(row.Line), reason.Error())
+	return r.w.Write(record)
+}
+
+// Close flushes and closes the rejects file, if any row was rejected.
+func (r *Rejects) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	if err := r.w.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,112 @@
+package csv
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRejectsPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"data/users.csv", "data/users.rejects.csv"},
+		{"data/users.tsv", "data/users.rejects.csv"},
+		{"data/users.csv.gz", "data/users.rejects.csv"},
+		{"data/users.csv.zst", "data/users.rejects.csv"},
+		{"file:///tmp/users.csv.xz", "/tmp/users.rejects.csv"},
+		{"s3://bucket/seeds/users.csv.gz", "users.rejects.csv"},
+		{"https://example.com/users.csv?token=1#sha256=00", "users.rejects.csv"},
+	}
+	for _, tt := range tests {
+		if got := RejectsPath(tt.path, Options{}); got != tt.want {
+			t.Errorf("RejectsPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRejectsPadsShortRows(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.csv")
+	dialect := Dialect{Delimiter: ';'}
+	r, err := NewRejects(path, []string{"id", "name", "email"}, dialect, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reject(Row{Values: []string{"1"}, Line: 2}, errors.New("wrong number of fields")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reject(Row{Values: []string{"2", "bob", "bob@example.com"}, Line: 3}, errors.New("bad; value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Count != 2 {
+		t.Errorf("Count = %d, want 2", r.Count)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "users.rejects.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := readAll(string(data), dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"id", "name", "email", "rejected_line", "rejected_reason"},
+		{"1", "", "", "2", "wrong number of fields"},
+		{"2", "bob", "bob@example.com", "3", "bad; value"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rejects = %q, want %q", got, want)
+	}
+}
+
+func TestRejectsNotCreatedWithoutRejects(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.csv")
+	r, err := NewRejects(path, []string{"id"}, Dialect{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(r.Path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat(%s) = %v, want the file not to exist", r.Path, err)
+	}
+}
+
+func TestRejectsFromFS(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	opts := Options{FS: fstest.MapFS{"seeds/users.csv": {Data: []byte("id\n")}}}
+	r, err := NewRejects("seeds/users.csv", []string{"id"}, Dialect{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Path != "users.rejects.csv" {
+		t.Errorf("Path = %q, want users.rejects.csv in the current directory", r.Path)
+	}
+	if err := r.Reject(Row{Values: []string{"x"}, Line: 2}, errors.New("invalid")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("users.rejects.csv"); err != nil {
+		t.Errorf("the rejects file was not written: %v", err)
+	}
+}
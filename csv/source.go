@@ -0,0 +1,346 @@
+package csv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	dm "github.com/datamigrate/migration"
+	"github.com/datamigrate/s3"
+)
+
+// ErrChecksumMismatch is returned when a pinned CSV does not have the
+// expected checksum.
+var ErrChecksumMismatch = errors.New("csv checksum mismatch")
+
+// Source opens the CSVs of a URL scheme. The csv_path of a data migration is
+// resolved to a Source from its scheme; paths without one are local files.
+// Sources report missing CSVs with errors matching fs.ErrNotExist.
+type Source interface {
+	// Open opens the CSV at the URL and returns its content and what is
+	// known of it.
+	Open(ctx context.Context, url string) (io.ReadCloser, Info, error)
+	// Stat checks that the CSV at the URL exists and returns what is known of
+	// it.
+	Stat(ctx context.Context, url string) (Info, error)
+}
+
+// Info describes a CSV as its Source reports it.
+type Info struct {
+	// Size is the size in bytes, -1 when it is not known.
+	Size int64
+	// ETag identifies the content of a remote CSV, "" when the source has
+	// none. Applied data migrations are checked for changes with it, instead
+	// of downloading and hashing their CSV again.
+	ETag string
+}
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = map[string]Source{
+		"file":  FileSource{},
+		"http":  HTTPSource{},
+		"https": HTTPSource{},
+		"s3":    S3Source{},
+	}
+)
+
+// Register makes a Source available for the csv_path URLs of a scheme,
+// replacing the Source registered for it before, if any.
+func Register(scheme string, source Source) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	sources[scheme] = source
+}
+
+// sourceFor returns the Source of the path and the scheme of the path.
+func sourceFor(path string) (Source, string, error) {
+	scheme := "file"
+	if i := strings.Index(path, "://"); i > 0 {
+		scheme = path[:i]
+	}
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	source, ok := sources[scheme]
+	if !ok {
+		return nil, "", fmt.Errorf("no csv source is registered for the scheme %q of %s", scheme, path)
+	}
+	return source, scheme, nil
+}
+
+// sourceIn returns the Source of the path like sourceFor, except that relative
+// paths are read from fsys when it is set.
+func sourceIn(path string, fsys fs.FS) (Source, string, error) {
+	if fsys != nil && !strings.Contains(path, "://") && !filepath.IsAbs(path) {
+		return FSSource{FS: fsys}, "fs", nil
+	}
+	return sourceFor(path)
+}
+
+// openSource opens the CSV at path, relative to fsys when set, and returns it
+// with what is known of it and its absolute path or URL. It returns a
+// *dm.MissingCSVError when the CSV does not exist. Reading a remote CSV stops
+// when ctx is done.
+func openSource(ctx context.Context, path string, fsys fs.FS) (io.ReadCloser, Info, string, error) {
+	source, scheme, err := sourceIn(path, fsys)
+	if err != nil {
+		return nil, Info{}, "", err
+	}
+	if scheme == "file" {
+		// get the abspath relative the cwd
+		absPath, err := filepath.Abs(strings.TrimPrefix(path, "file://"))
+		if err != nil {
+			return nil, Info{}, "", fmt.Errorf("an error occurred while getting the absolute path of the csv file: %w", err)
+		}
+		path = absPath
+	}
+	file, info, err := source.Open(ctx, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, Info{}, "", &dm.MissingCSVError{Path: path}
+	}
+	if err != nil {
+		return nil, Info{}, "", err
+	}
+	return file, info, path, nil
+}
+
+// Stat checks that the CSV at a csv_path exists with its Source and returns
+// what is known of it. It returns a *dm.MissingCSVError when the CSV does not
+// exist. Relative paths are looked up in opts.FS when it is set.
+func Stat(ctx context.Context, path string, opts Options) (Info, error) {
+	source, _, err := sourceIn(path, opts.FS)
+	if err != nil {
+		return Info{}, err
+	}
+	info, err := source.Stat(ctx, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Info{}, &dm.MissingCSVError{Path: path}
+	}
+	return info, err
+}
+
+// Exists checks that the CSV at a csv_path exists, see Stat.
+func Exists(ctx context.Context, path string, opts Options) error {
+	_, err := Stat(ctx, path, opts)
+	return err
+}
+
+// localName returns the file name of a CSV path or URL, without its query or
+// fragment.
+func localName(p string) string {
+	if i := strings.Index(p, "://"); i > 0 {
+		p = p[i+3:]
+		if j := strings.IndexAny(p, "?#"); j >= 0 {
+			p = p[:j]
+		}
+		return path.Base(p)
+	}
+	return p
+}
+
+// FileSource reads CSVs from the local file system. It handles the paths
+// without a scheme and file:// URLs.
+type FileSource struct{}
+
+func (FileSource) Open(ctx context.Context, url string) (io.ReadCloser, Info, error) {
+	file, err := os.Open(strings.TrimPrefix(url, "file://"))
+	if err != nil {
+		return nil, Info{}, fmt.Errorf("an error occurred while opening the file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, Info{}, fmt.Errorf("an error occurred while reading the file size: %w", err)
+	}
+	return file, Info{Size: info.Size()}, nil
+}
+
+func (FileSource) Stat(ctx context.Context, url string) (Info, error) {
+	info, err := os.Stat(strings.TrimPrefix(url, "file://"))
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Size: info.Size()}, nil
+}
+
+// FSSource reads CSVs from a file system such as an embed.FS. Register it
+// under a scheme of its own, e.g.
+//
+//	csv.Register("embed", csv.FSSource{FS: seeds})
+//
+// to read the csv_path embed://seeds/users.csv from seeds/users.csv in FS.
+type FSSource struct {
+	FS fs.FS
+}
+
+func (s FSSource) Open(ctx context.Context, url string) (io.ReadCloser, Info, error) {
+	file, err := s.FS.Open(fsName(url))
+	if err != nil {
+		return nil, Info{}, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, Info{}, err
+	}
+	return file, Info{Size: info.Size()}, nil
+}
+
+func (s FSSource) Stat(ctx context.Context, url string) (Info, error) {
+	info, err := fs.Stat(s.FS, fsName(url))
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Size: info.Size()}, nil
+}
+
+func fsName(url string) string {
+	if i := strings.Index(url, "://"); i >= 0 {
+		url = url[i+3:]
+	}
+	return path.Clean(filepath.ToSlash(url))
+}
+
+// HTTPSource downloads CSVs over HTTP and HTTPS. A CSV can be pinned to its
+// SHA-256 with a #sha256=<hex> fragment: reading it then fails with
+// ErrChecksumMismatch when the content differs.
+type HTTPSource struct {
+	// Client is the client used for the requests. When nil, a client that
+	// times out connecting and waiting for the response headers is used.
+	Client *http.Client
+}
+
+// defaultClient bounds the time to connect and to get the response headers.
+// The body of a large CSV can take much longer to stream, so it is only
+// bounded by the context of the load.
+var defaultClient = newDefaultClient()
+
+func newDefaultClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	return &http.Client{Transport: transport}
+}
+
+func (s HTTPSource) Open(ctx context.Context, url string) (io.ReadCloser, Info, error) {
+	url, pin := splitPin(url)
+	resp, err := s.do(ctx, http.MethodGet, url)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	info := Info{Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}
+	if pin == "" {
+		return resp.Body, info, nil
+	}
+	return &checksumReader{body: resp.Body, url: url, want: pin, hash: sha256.New()}, info, nil
+}
+
+func (s HTTPSource) Stat(ctx context.Context, url string) (Info, error) {
+	url, _ = splitPin(url)
+	resp, err := s.do(ctx, http.MethodHead, url)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusMethodNotAllowed {
+		return Info{Size: -1}, nil
+	}
+	return Info{Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}, nil
+}
+
+func (s HTTPSource) do(ctx context.Context, method string, url string) (*http.Response, error) {
+	client := s.Client
+	if client == nil {
+		client = defaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("an error occurred while requesting %s: %w", url, err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", url, fs.ErrNotExist)
+	case resp.StatusCode == http.StatusMethodNotAllowed && method == http.MethodHead:
+		// the server only serves GET, assume the CSV is there
+		return resp, nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		resp.Body.Close()
+		return nil, fmt.Errorf("an error occurred while requesting %s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// splitPin splits the #sha256=<hex> fragment off a URL.
+func splitPin(url string) (string, string) {
+	i := strings.Index(url, "#")
+	if i < 0 {
+		return url, ""
+	}
+	pin, ok := strings.CutPrefix(url[i+1:], "sha256=")
+	if !ok {
+		return url[:i], ""
+	}
+	return url[:i], strings.ToLower(pin)
+}
+
+// checksumReader hashes the body while it is read and fails at its end when
+// the hash is not the expected one.
+type checksumReader struct {
+	body io.ReadCloser
+	url  string
+	want string
+	hash hash.Hash
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(r.hash.Sum(nil)); got != r.want {
+			return n, fmt.Errorf("%w: %s has sha256 %s, expected %s", ErrChecksumMismatch, r.url, got, r.want)
+		}
+	}
+	return n, err
+}
+
+func (r *checksumReader) Close() error {
+	return r.body.Close()
+}
+
+// S3Source streams CSVs from S3 compatible object storage, see package s3.
+type S3Source struct{}
+
+func (S3Source) Open(ctx context.Context, url string) (io.ReadCloser, Info, error) {
+	body, obj, err := s3.Open(ctx, url)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	return body, Info{Size: obj.Size, ETag: obj.ETag}, nil
+}
+
+func (S3Source) Stat(ctx context.Context, url string) (Info, error) {
+	obj, err := s3.Stat(ctx, url)
+	if errors.Is(err, s3.ErrNotFound) {
+		return Info{}, fmt.Errorf("%w: %s", fs.ErrNotExist, err)
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Size: obj.Size, ETag: obj.ETag}, nil
+}
@@ -0,0 +1,117 @@
+package csv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	dm "github.com/datamigrate/migration"
+)
+
+const sourceTestData = "id,name\n1,ann\n"
+
+// readRows reads every row of the CSV at path.
+func readRows(t *testing.T, path string) ([][]string, error) {
+	t.Helper()
+	s, err := OpenCSV(context.Background(), path, Dialect{}, Options{})
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	var rows [][]string
+	for s.Next() {
+		rows = append(rows, s.Row().Values)
+	}
+	return rows, s.Err()
+}
+
+func newCSVServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users.csv", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(sourceTestData))
+	})
+	mux.HandleFunc("/get-only.csv", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Write([]byte(sourceTestData))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHTTPSourcePin(t *testing.T) {
+	srv := newCSVServer(t)
+	sum := sha256.Sum256([]byte(sourceTestData))
+
+	rows, err := readRows(t, srv.URL+"/users.csv#sha256="+hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"1", "ann"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+
+	_, err = readRows(t, srv.URL+"/users.csv#sha256="+strings.Repeat("0", 64))
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("err = %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestHTTPSourceStat(t *testing.T) {
+	srv := newCSVServer(t)
+	ctx := context.Background()
+
+	info, err := Stat(ctx, srv.URL+"/users.csv", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Info{Size: int64(len(sourceTestData)), ETag: `"v1"`}); info != want {
+		t.Errorf("Stat = %+v, want %+v", info, want)
+	}
+
+	if err := Exists(ctx, srv.URL+"/missing.csv", Options{}); !errors.Is(err, dm.ErrMissingCSV) {
+		t.Errorf("Exists(missing) = %v, want dm.ErrMissingCSV", err)
+	}
+	if _, err := readRows(t, srv.URL+"/missing.csv"); !errors.Is(err, dm.ErrMissingCSV) {
+		t.Errorf("OpenCSV(missing) = %v, want dm.ErrMissingCSV", err)
+	}
+
+	// a server that only serves GET is assumed to have the CSV
+	info, err = Stat(ctx, srv.URL+"/get-only.csv", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != -1 {
+		t.Errorf("Stat(get-only) = %+v, want an unknown size", info)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register("testfs", FSSource{FS: fstest.MapFS{"seeds/users.csv": {Data: []byte(sourceTestData)}}})
+
+	rows, err := readRows(t, "testfs://seeds/users.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"1", "ann"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+	if err := Exists(context.Background(), "testfs://seeds/missing.csv", Options{}); !errors.Is(err, dm.ErrMissingCSV) {
+		t.Errorf("Exists(missing) = %v, want dm.ErrMissingCSV", err)
+	}
+	if _, err := readRows(t, "unknown://users.csv"); err == nil {
+		t.Error("read a CSV of an unregistered scheme, want an error")
+	}
+}
@@ -0,0 +1,250 @@
+package csv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// Options configure how a Stream opens its file.
+type Options struct {
+	// Progress, when set, is called with the path of the file and its size
+	// in bytes, -1 when unknown, and returns the writer the bytes read from
+	// the file are copied to, e.g. a progress bar. A writer that is also an
+	// io.Closer is closed at the end of the file.
+	Progress func(path string, size int64) io.Writer
+	// FS, when set, is the file system relative paths are read from instead
+	// of the local one, such as the one the data migrations were read from.
+	FS fs.FS
+}
+
+// RecordReader reads the records of a data file: *Reader reads CSV and
+// *JSONReader reads JSON arrays and NDJSON.
+type RecordReader interface {
+	// Read reads the next record. It returns io.EOF when there are no more
+	// records. An invalid record after which reading can go on, such as a
+	// JSON object missing a key, is returned along with the error, so that
+	// it can be rejected.
+	Read() ([]string, error)
+	// Line returns the line the last record read started on.
+	Line() int
+	// FieldPos returns the line and column of the given field of the last
+	// record read.
+	FieldPos(field int) (line int, column int)
+	// FieldNull reports whether the given field of the last record read is
+	// NULL, given the null marker of its column, nil when it has none.
+	FieldNull(field int, marker *string) bool
+}
+
+// Stream reads a CSV or JSON file one row at a time, so that memory use does
+// not depend on the size of the file.
+//
+//	s, err := csv.OpenCSV(ctx, path, dialect, csv.Options{})
+//	defer s.Close()
+//	for s.Next() {
+//		row := s.Row()
+//	}
+//	err = s.Err()
+type Stream struct {
+	Path    string
+	Columns []string
+	// Nulls holds the null marker of each column, nil for columns without
+	// one. Unquoted fields equal to the marker are read as NULL. Set it before
+	// the first call to Next.
+	Nulls []*string
+	// Mapping, when set, selects and orders the fields of every row to match
+	// the table columns. Nulls and Converter apply to the CSV fields.
+	Mapping *Mapping
+	// Converter, when set, checks and converts every row read. A value that
+	// does not match its column type stops the stream with a *TypeError.
+	Converter *Converter
+	// OnReject, when set, is called with the rows that have the wrong number
+	// of fields or invalid values, and the reason. The rows are skipped
+	// instead of stopping the stream, unless OnReject returns an error.
+	OnReject func(row Row, reason error) error
+
+	path     string
+	info     Info
+	file     io.ReadCloser
+	raw      io.Reader
+	hash     hash.Hash
+	body     io.ReadCloser
+	reader   RecordReader
+	progress io.Writer
+	row      Row
+	err      error
+}
+
+// OpenCSV opens the CSV file at path and reads its header. The path can be a
+// local file or the URL of a registered Source. A CSV compressed with gzip,
+// zstd, bzip2 or xz is decompressed while it is read. Reading a remote CSV
+// stops when ctx is done.
+func OpenCSV(ctx context.Context, path string, dialect Dialect, opts Options) (*Stream, error) {
+	s, err := openStream(ctx, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.reader = NewReader(s.body, path, dialect)
+
+	// the first record is the header
+	header, err := s.reader.Read()
+	if err == io.EOF {
+		s.Close()
+		return nil, fmt.Errorf("the csv file %s is empty", path)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	for i, col := range header {
+		header[i] = strings.TrimSpace(col)
+	}
+	s.Columns = header
+
+	return s, nil
+}
+
+// openStream opens the file at path, decompressing it when needed, for a
+// Stream to read.
+func openStream(ctx context.Context, path string, opts Options) (*Stream, error) {
+	file, info, absPath, err := openSource(ctx, path, opts.FS)
+	if err != nil {
+		return nil, err
+	}
+	s := &Stream{Path: absPath, path: path, info: info, file: file, hash: sha256.New()}
+
+	// the checksum and progress are of the bytes read from the source,
+	// compressed or not
+	s.raw = io.TeeReader(file, s.hash)
+	if opts.Progress != nil {
+		s.progress = opts.Progress(path, info.Size)
+		s.raw = io.TeeReader(s.raw, s.progress)
+	}
+	s.body, err = decompress(s.raw, path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Next reads the next row. It returns false at the end of the file or on an
+// error, which is then reported by Err.
+func (s *Stream) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	for {
+		record, err := s.reader.Read()
+		if err == io.EOF {
+			// a decompressor may stop before the end of the file
+			if _, err := io.Copy(io.Discard, s.raw); err != nil {
+				s.err = err
+				return false
+			}
+			if c, ok := s.progress.(io.Closer); ok {
+				c.Close()
+			}
+			return false
+		}
+		if err != nil && record == nil {
+			s.err = err
+			return false
+		}
+		row := Row{Values: record, Line: s.reader.Line()}
+		if err == nil {
+			err = s.checkRow(row)
+		}
+		if err == nil {
+			row.Null = s.nullFields(record)
+			if s.Converter != nil {
+				err = s.Converter.Convert(row, s.reader)
+			}
+		}
+		if err != nil {
+			if s.OnReject == nil {
+				s.err = err
+				return false
+			}
+			if err := s.OnReject(row, err); err != nil {
+				s.err = err
+				return false
+			}
+			continue
+		}
+		if s.Mapping != nil {
+			row = row.project(s.Mapping.Fields)
+		}
+		s.row = row
+		return true
+	}
+}
+
+// checkRow checks that the row has a field for every column.
+func (s *Stream) checkRow(row Row) error {
+	if len(row.Values) != len(s.Columns) {
+		return &ParseError{Path: s.path, Line: row.Line, Column: 1,
+			Err: fmt.Errorf("%w: expected %d, got %d", ErrFieldCount, len(s.Columns), len(row.Values))}
+	}
+	return nil
+}
+
+// nullFields reports which fields of the record are NULL.
+func (s *Stream) nullFields(record []string) []bool {
+	null := make([]bool, len(record))
+	for i := range record {
+		var marker *string
+		if i < len(s.Nulls) {
+			marker = s.Nulls[i]
+		}
+		null[i] = s.reader.FieldNull(i, marker)
+	}
+	return null
+}
+
+// TableColumns returns the table columns the rows are loaded into.
+func (s *Stream) TableColumns() []string {
+	if s.Mapping != nil {
+		return s.Mapping.Columns
+	}
+	return s.Columns
+}
+
+// Row returns the row read by the last call to Next.
+func (s *Stream) Row() Row {
+	return s.row
+}
+
+// Reader returns the underlying reader, e.g. to look up field positions of
+// the current row.
+func (s *Stream) Reader() RecordReader {
+	return s.reader
+}
+
+// Checksum returns the hex encoded SHA-256 of the bytes read from the file.
+// Once Next returned false without an error, it is the checksum of the whole
+// file, computed on the very bytes the rows were read from.
+func (s *Stream) Checksum() string {
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+// Info returns what the source of the file reported when it was opened.
+func (s *Stream) Info() Info {
+	return s.info
+}
+
+// Err returns the error that stopped Next, if any.
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// Close closes the underlying file or object.
+func (s *Stream) Close() error {
+	s.body.Close()
+	return s.file.Close()
+}
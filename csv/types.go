@@ -0,0 +1,272 @@
+package csv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	dm "github.com/datamigrate/migration"
+)
+
+// The type families values are checked and converted against. Column types
+// outside of these, e.g. text or arrays, are loaded as is.
+const (
+	kindText = iota
+	kindInt
+	kindFloat
+	kindBool
+	kindDate
+	kindTimestamp
+	kindTimestampTZ
+	kindJSON
+	kindUUID
+)
+
+var kinds = map[string]int{
+	"int":                         kindInt,
+	"int2":                        kindInt,
+	"int4":                        kindInt,
+	"int8":                        kindInt,
+	"integer":                     kindInt,
+	"smallint":                    kindInt,
+	"bigint":                      kindInt,
+	"serial":                      kindInt,
+	"serial2":                     kindInt,
+	"serial4":                     kindInt,
+	"serial8":                     kindInt,
+	"smallserial":                 kindInt,
+	"bigserial":                   kindInt,
+	"float":                       kindFloat,
+	"float4":                      kindFloat,
+	"float8":                      kindFloat,
+	"real":                        kindFloat,
+	"double precision":            kindFloat,
+	"decimal":                     kindFloat,
+	"numeric":                     kindFloat,
+	"bool":                        kindBool,
+	"boolean":                     kindBool,
+	"date":                        kindDate,
+	"timestamp":                   kindTimestamp,
+	"timestamp without time zone": kindTimestamp,
+	"timestamptz":                 kindTimestampTZ,
+	"timestamp with time zone":    kindTimestampTZ,
+	"json":                        kindJSON,
+	"jsonb":                       kindJSON,
+	"uuid":                        kindUUID,
+}
+
+// bit sizes of the integer types, anything else is 64 bits
+var intBits = map[string]int{
+	"int2": 16, "smallint": 16, "serial2": 16, "smallserial": 16,
+	"int": 32, "int4": 32, "integer": 32, "serial": 32, "serial4": 32,
+}
+
+var boolValues = map[string]string{
+	"true": "true", "t": "true", "yes": "true", "y": "true", "on": "true", "1": "true",
+	"false": "false", "f": "false", "no": "false", "n": "false", "off": "false", "0": "false",
+}
+
+const (
+	dateFormat        = "2006-01-02"
+	timestampFormat   = "2006-01-02 15:04:05.999999999"
+	timestampTZFormat = "2006-01-02 15:04:05.999999999Z07:00"
+)
+
+// zoneElements are the elements of a Go time layout that read a time zone.
+var zoneElements = []string{"MST", "Z07", "-07"}
+
+// typeModifier matches the modifier of a type name, e.g. the (10,2) of
+// numeric(10,2) or the (3) of timestamp(3) with time zone.
+var typeModifier = regexp.MustCompile(`\s*\([^)]*\)`)
+
+var uuidPattern = regexp.MustCompile(`^\{?[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}\}?$`)
+
+// TypeError is returned for a CSV value that does not match the type of its
+// column. Line and Column are 1-based and point at the start of the field.
+type TypeError struct {
+	Path   string
+	Line   int
+	Column int
+	Value  string
+	Type   string
+	Err    error
+}
+
+func (e *TypeError) Error() string {
+	msg := fmt.Sprintf("%s:%d:%d: cannot load %q as %s", e.Path, e.Line, e.Column, e.Value, e.Type)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *TypeError) Unwrap() error { return e.Err }
+
+func (e *TypeError) Is(target error) bool { return target == dm.ErrInvalidValue }
+
+type columnType struct {
+	name string
+	kind int
+	bits int
+}
+
+// Converter checks CSV values against the column types of a data migration
+// and converts common formats to the ones PostgreSQL accepts: yes/no
+// booleans, dates in the configured layouts and numbers with thousands
+// separators. Dates that match none of the layouts are left to PostgreSQL.
+type Converter struct {
+	path      string
+	types     []columnType
+	layouts   []string
+	thousands *regexp.Regexp
+	separator string
+	buf       []string
+}
+
+// NewConverter returns a Converter for the given CSV header, typed as the
+// columns of the data migration they are loaded into.
+func NewConverter(path string, columns []string, m *dm.MigrationDDL) *Converter {
+	c := &Converter{
+		path:      path,
+		types:     make([]columnType, len(columns)),
+		layouts:   m.DateLayouts,
+		separator: ",",
+	}
+	if m.ThousandsSeparator != "" {
+		c.separator = m.ThousandsSeparator
+	}
+	sep := regexp.QuoteMeta(c.separator)
+	c.thousands = regexp.MustCompile(`^[+-]?\d{1,3}(` + sep + `\d{3})+(\.\d*)?$`)
+
+	for i, header := range columns {
+		if col, ok := m.ColumnByHeader(header); ok {
+			c.types[i] = parseColumnType(col.Type)
+		}
+	}
+	return c
+}
+
+func parseColumnType(name string) columnType {
+	t := typeModifier.ReplaceAllString(strings.ToLower(name), " ")
+	t = strings.Join(strings.Fields(t), " ")
+	bits, ok := intBits[t]
+	if !ok {
+		bits = 64
+	}
+	return columnType{name: name, kind: kinds[t], bits: bits}
+}
+
+// Convert checks and converts the values of a row in place. The reader is the
+// one the row was read from and is used to report positions. The row is left
+// untouched when any value is invalid.
+func (c *Converter) Convert(row Row, r RecordReader) error {
+	var errs []error
+	c.buf = c.buf[:0]
+	for i, value := range row.Values {
+		if i >= len(c.types) || c.types[i].kind == kindText || row.IsNull(i) {
+			c.buf = append(c.buf, value)
+			continue
+		}
+		converted, err := c.convert(value, c.types[i])
+		if err != nil {
+			line, col := r.FieldPos(i)
+			errs = append(errs, &TypeError{Path: c.path, Line: line, Column: col, Value: value, Type: c.types[i].name, Err: err})
+			continue
+		}
+		c.buf = append(c.buf, converted)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	copy(row.Values, c.buf)
+	return nil
+}
+
+func (c *Converter) convert(value string, t columnType) (string, error) {
+	value = strings.TrimSpace(value)
+	switch t.kind {
+	case kindInt:
+		value = c.stripThousands(value)
+		if _, err := strconv.ParseInt(value, 10, t.bits); err != nil {
+			return "", unwrapNumError(err)
+		}
+		return value, nil
+	case kindFloat:
+		value = c.stripThousands(value)
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "", unwrapNumError(err)
+		}
+		return value, nil
+	case kindBool:
+		b, ok := boolValues[strings.ToLower(value)]
+		if !ok {
+			return "", errors.New("expected true/false, yes/no, on/off or 1/0")
+		}
+		return b, nil
+	case kindDate, kindTimestamp, kindTimestampTZ:
+		return c.convertTime(value, t.kind)
+	case kindJSON:
+		if !json.Valid([]byte(value)) {
+			return "", errors.New("invalid JSON")
+		}
+		return value, nil
+	case kindUUID:
+		if !uuidPattern.MatchString(value) {
+			return "", errors.New("invalid UUID")
+		}
+		return value, nil
+	}
+	return value, nil
+}
+
+func (c *Converter) stripThousands(value string) string {
+	if c.thousands.MatchString(value) {
+		return strings.ReplaceAll(value, c.separator, "")
+	}
+	return value
+}
+
+// convertTime rewrites a value matching one of the date layouts in the ISO
+// 8601 format. A timestamp with time zone keeps the zone it was written with,
+// or none so PostgreSQL reads it in the session time zone. Other values are
+// returned as is for PostgreSQL to parse, which accepts many more formats.
+func (c *Converter) convertTime(value string, kind int) (string, error) {
+	for _, layout := range c.layouts {
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		switch {
+		case kind == kindDate:
+			return t.Format(dateFormat), nil
+		case kind == kindTimestampTZ && hasZone(layout):
+			return t.Format(timestampTZFormat), nil
+		default:
+			return t.Format(timestampFormat), nil
+		}
+	}
+	return value, nil
+}
+
+func hasZone(layout string) bool {
+	for _, elem := range zoneElements {
+		if strings.Contains(layout, elem) {
+			return true
+		}
+	}
+	return false
+}
+
+// unwrapNumError drops the function name and input from strconv errors, the
+// TypeError already reports the value.
+func unwrapNumError(err error) error {
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		return numErr.Err
+	}
+	return err
+}
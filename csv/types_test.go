@@ -0,0 +1,150 @@
+package csv
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	dm "github.com/datamigrate/migration"
+)
+
+// convertValue converts a single CSV value loaded into a column of the given
+// type.
+func convertValue(t *testing.T, value string, colType string, m dm.MigrationDDL) (string, error) {
+	t.Helper()
+	m.Columns = []dm.Column{{Name: "v", Type: colType}}
+	// a dialect that reads JSON and commas as is
+	r := NewReader(strings.NewReader(value+"\n"), "test.csv", Dialect{Delimiter: '|', Quote: '`'})
+	record, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := Row{Values: record}
+	if err := NewConverter("test.csv", []string{"v"}, &m).Convert(row, r); err != nil {
+		return "", err
+	}
+	return row.Values[0], nil
+}
+
+func TestConverterConvert(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		colType string
+		m       dm.MigrationDDL
+		want    string
+		wantErr bool
+	}{
+		{name: "bool yes", value: "yes", colType: "boolean", want: "true"},
+		{name: "bool upper case", value: "OFF", colType: "bool", want: "false"},
+		{name: "bool digit", value: "1", colType: "bool", want: "true"},
+		{name: "bool invalid", value: "maybe", colType: "bool", wantErr: true},
+		{name: "int", value: " 42 ", colType: "integer", want: "42"},
+		{name: "int thousands", value: "1,234,567", colType: "bigint", want: "1234567"},
+		{name: "int custom thousands", value: "1.234", colType: "int", m: dm.MigrationDDL{ThousandsSeparator: "."}, want: "1234"},
+		{name: "int out of range", value: "40000", colType: "smallint", wantErr: true},
+		{name: "int invalid", value: "12a", colType: "int", wantErr: true},
+		{name: "numeric thousands", value: "-1,234.50", colType: "numeric(10,2)", want: "-1234.50"},
+		{name: "misplaced thousands", value: "12,34", colType: "numeric", wantErr: true},
+		{name: "text untouched", value: " 1,234 ", colType: "varchar(20)", want: " 1,234 "},
+		{name: "date layout", value: "31/12/2020", colType: "date", m: dm.MigrationDDL{DateLayouts: []string{"02/01/2006"}}, want: "2020-12-31"},
+		{name: "date without layout", value: "Dec 31 2020", colType: "date", want: "Dec 31 2020"},
+		{name: "timestamp layout", value: "31/12/2020 10:30", colType: "timestamp", m: dm.MigrationDDL{DateLayouts: []string{"02/01/2006 15:04"}}, want: "2020-12-31 10:30:00"},
+		{name: "timestamptz layout keeps no zone", value: "31/12/2020 10:30", colType: "timestamptz", m: dm.MigrationDDL{DateLayouts: []string{"02/01/2006 15:04"}}, want: "2020-12-31 10:30:00"},
+		{name: "timestamptz layout with zone", value: "31/12/2020 10:30 -0800", colType: "timestamptz", m: dm.MigrationDDL{DateLayouts: []string{"02/01/2006 15:04 -0700"}}, want: "2020-12-31 10:30:00-08:00"},
+		{name: "timestamptz with precision", value: "2020-01-01 10:00 -0800", colType: "timestamp(3) with time zone", m: dm.MigrationDDL{DateLayouts: []string{"2006-01-02 15:04 -0700"}}, want: "2020-01-01 10:00:00-08:00"},
+		{name: "int is 32 bits", value: "3000000000", colType: "INT", wantErr: true},
+		{name: "bigint is 64 bits", value: "3000000000", colType: "bigint", want: "3000000000"},
+		{name: "timestamptz passed through", value: "2020-01-01 10:00:00 PST", colType: "timestamp with time zone", want: "2020-01-01 10:00:00 PST"},
+		{name: "uuid", value: "A0EEBC99-9C0B-4EF8-BB6D-6BB9BD380A11", colType: "uuid", want: "A0EEBC99-9C0B-4EF8-BB6D-6BB9BD380A11"},
+		{name: "uuid braces", value: "{a0eebc999c0b4ef8bb6d6bb9bd380a11}", colType: "uuid", want: "{a0eebc999c0b4ef8bb6d6bb9bd380a11}"},
+		{name: "uuid invalid", value: "a0eebc99-9c0b", colType: "uuid", wantErr: true},
+		{name: "json", value: `{"a": [1, 2]}`, colType: "jsonb", want: `{"a": [1, 2]}`},
+		{name: "json string", value: `"text"`, colType: "json", want: `"text"`},
+		{name: "json invalid", value: `{"a":`, colType: "jsonb", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convertValue(t, tt.value, tt.colType, tt.m)
+			if tt.wantErr {
+				if !errors.Is(err, dm.ErrInvalidValue) {
+					t.Fatalf("err = %v, want dm.ErrInvalidValue", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Convert(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConverterTypeErrorPositions(t *testing.T) {
+	m := &dm.MigrationDDL{Columns: []dm.Column{
+		{Name: "id", Type: "int"},
+		{Name: "name", Type: "text"},
+		{Name: "active", Type: "bool"},
+	}}
+	header := []string{"id", "name", "active"}
+	r := NewReader(strings.NewReader("1,ann,yes\nx,\"bob\nby\",maybe\n"), "test.csv", Dialect{})
+	c := NewConverter("test.csv", header, m)
+
+	record, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Convert(Row{Values: record}, r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	record, err = r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := Row{Values: record}
+	err = c.Convert(row, r)
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("err = %v, want the joined type errors", err)
+	}
+	want := []struct {
+		value        string
+		line, column int
+	}{
+		{"x", 2, 1},
+		{"maybe", 3, 5},
+	}
+	errs := joined.Unwrap()
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d: %v", len(errs), len(want), err)
+	}
+	for i, w := range want {
+		var typeErr *TypeError
+		if !errors.As(errs[i], &typeErr) {
+			t.Fatalf("errs[%d] = %v, want a *TypeError", i, errs[i])
+		}
+		if typeErr.Value != w.value || typeErr.Line != w.line || typeErr.Column != w.column || typeErr.Path != "test.csv" {
+			t.Errorf("errs[%d] = %q at %s:%d:%d, want %q at test.csv:%d:%d",
+				i, typeErr.Value, typeErr.Path, typeErr.Line, typeErr.Column, w.value, w.line, w.column)
+		}
+	}
+	if row.Values[0] != "x" || row.Values[2] != "maybe" {
+		t.Errorf("row = %q, want it untouched", row.Values)
+	}
+}
+
+func TestConverterSkipsNulls(t *testing.T) {
+	m := &dm.MigrationDDL{Columns: []dm.Column{{Name: "id", Type: "int"}}}
+	r := NewReader(strings.NewReader("NULL\n"), "test.csv", Dialect{})
+	record, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := Row{Values: record, Null: []bool{true}}
+	if err := NewConverter("test.csv", []string{"id"}, m).Convert(row, r); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package csv
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// Writer writes CSV records in a dialect, quoting the fields that need it.
+type Writer struct {
+	dialect Dialect
+	w       *bufio.Writer
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer, dialect Dialect) *Writer {
+	return &Writer{dialect: dialect.withDefaults(), w: bufio.NewWriter(w)}
+}
+
+// Write writes a single record.
+func (w *Writer) Write(record []string) error {
+	for i, field := range record {
+		if i > 0 {
+			if _, err := w.w.WriteRune(w.dialect.Delimiter); err != nil {
+				return err
+			}
+		}
+		if err := w.writeField(field); err != nil {
+			return err
+		}
+	}
+	_, err := w.w.WriteRune('\n')
+	return err
+}
+
+func (w *Writer) writeField(field string) error {
+	special := string(w.dialect.Delimiter) + string(w.dialect.Quote) + "\r\n"
+	if w.dialect.Escape != noEscape {
+		special += string(w.dialect.Escape)
+	}
+	if !strings.ContainsAny(field, special) {
+		_, err := w.w.WriteString(field)
+		return err
+	}
+
+	var b strings.Builder
+	b.WriteRune(w.dialect.Quote)
+	for _, c := range field {
+		switch {
+		case w.dialect.Escape != noEscape && (c == w.dialect.Quote || c == w.dialect.Escape):
+			b.WriteRune(w.dialect.Escape)
+		case w.dialect.Escape == noEscape && c == w.dialect.Quote:
+			// a quote is escaped by doubling it
+			b.WriteRune(c)
+		}
+		b.WriteRune(c)
+	}
+	b.WriteRune(w.dialect.Quote)
+	_, err := w.w.WriteString(b.String())
+	return err
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
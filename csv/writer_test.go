@@ -0,0 +1,60 @@
+package csv
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestWriterRoundTrip(t *testing.T) {
+	records := [][]string{
+		{"plain", "", "with space"},
+		{"a,b", `say "hi"`, "line1\nline2"},
+		{`back\slash`, `\"`, "cr\rlf\r\n"},
+		{"semi;colon", "it's", "`tick`"},
+	}
+	dialects := []struct {
+		name    string
+		dialect Dialect
+	}{
+		{"default", Dialect{}},
+		{"escape", Dialect{Escape: '\\'}},
+		{"custom delimiter and quote", Dialect{Delimiter: ';', Quote: '\''}},
+		{"custom escape and quote", Dialect{Delimiter: '|', Quote: '`', Escape: '\\'}},
+	}
+	for _, tt := range dialects {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf, tt.dialect)
+			for _, record := range records {
+				if err := w.Write(record); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := readAll(buf.String(), tt.dialect)
+			if err != nil {
+				t.Fatalf("reading %q: %v", buf.String(), err)
+			}
+			if !reflect.DeepEqual(got, records) {
+				t.Errorf("read back %q, want %q", got, records)
+			}
+		})
+	}
+}
+
+func TestWriterQuotesOnlyWhenNeeded(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, Dialect{Escape: '\\'})
+	if err := w.Write([]string{"a", "b,c", `d"e`, `f\g`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "a,\"b,c\",\"d\\\"e\",\"f\\\\g\"\n"; buf.String() != want {
+		t.Errorf("wrote %q, want %q", buf.String(), want)
+	}
+}
@@ -1,14 +1,14 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
 	"github.com/datamigrate/csv"
+	dm "github.com/datamigrate/migration"
 	"github.com/golang-migrate/migrate/v4/database"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
-	"github.com/lib/pq"
-	"github.com/schollz/progressbar/v3"
 )
 
 func ConnectDatabase(dsn string) (database.Driver, error) {
@@ -23,14 +23,14 @@ func ConnectDatabase(dsn string) (database.Driver, error) {
 	}
 	return driver, nil
 }
-func CheckDataMigrationTableExists(db *sql.DB) bool {
+func CheckDataMigrationTableExists(ctx context.Context, db *sql.DB) bool {
 	// Check if the data migration table exists
-	err := db.Ping()
+	err := db.PingContext(ctx)
 	if err != nil {
 		return false
 	}
 
-	_, err = db.Exec(`SELECT 1 FROM schema_datamigrations LIMIT 1;`)
+	_, err = db.ExecContext(ctx, `SELECT 1 FROM schema_datamigrations LIMIT 1;`)
 	if err != nil {
 		return err == nil
 	}
@@ -38,14 +38,14 @@ func CheckDataMigrationTableExists(db *sql.DB) bool {
 	return true
 }
 
-func CreateDataMigrationTable(db *sql.DB) error {
+func CreateDataMigrationTable(ctx context.Context, db *sql.DB) error {
 	// Create the data migration table
-	err := db.Ping()
+	err := db.PingContext(ctx)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(`
+	_, err = db.ExecContext(ctx, `
 		CREATE TABLE IF NOT EXISTS schema_datamigrations (
 			version bigint NOT NULL,
 			dirty boolean NOT NULL,
@@ -55,31 +55,35 @@ func CreateDataMigrationTable(db *sql.DB) error {
 		return err
 	}
 
-	return nil
+	err = CreateHistoryTable(ctx, db)
+	if err != nil {
+		return err
+	}
+	return CreateKeysTable(ctx, db)
 }
 
-func DropDataMigrationTable(db *sql.DB) error {
+func DropDataMigrationTable(ctx context.Context, db *sql.DB) error {
 	// Drop the data migration table
-	err := db.Ping()
+	err := db.PingContext(ctx)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(`DROP TABLE IF EXISTS schema_datamigrations;`)
+	_, err = db.ExecContext(ctx, `DROP TABLE IF EXISTS schema_datamigrations, schema_datamigrations_history, schema_datamigrations_keys;`)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
-func TruncateTable(db *sql.DB, tableName string) error {
+func TruncateTable(ctx context.Context, db *sql.DB, table Table) error {
 	// Truncate the table
-	err := db.Ping()
+	err := db.PingContext(ctx)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(fmt.Sprintf(`TRUNCATE TABLE %s;`, tableName))
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`TRUNCATE TABLE %s;`, table.Identifier()))
 	if err != nil {
 		return err
 	}
@@ -87,63 +91,134 @@ func TruncateTable(db *sql.DB, tableName string) error {
 	return nil
 }
 
-// WriteCsvToDb copies the CSV data into the database using PostgreSQL COPY command.
-func WriteCsvToDb(db *sql.DB, csv *csv.CSV, tableName string) error {
-	// Begin a transaction
+// TruncateTableTx truncates the table inside the given transaction.
+func TruncateTableTx(ctx context.Context, tx *sql.Tx, table Table) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`TRUNCATE TABLE %s;`, table.Identifier()))
+	return err
+}
+
+// LoadOptions configures how WriteCsvToDb loads the rows into a table.
+type LoadOptions struct {
+	// Pre and Post are run before and after the rows are loaded.
+	Pre  string
+	Post string
+	// Mode is one of the migration load modes, append when empty.
+	Mode string
+	// Keys are the conflict columns of the upsert and sync modes. They
+	// default to the primary key of the table.
+	Keys []string
+	// RecordKeys are the columns whose values are recorded under Version for
+	// every inserted row, see DeleteInsertedRows. Rows an upsert only updated
+	// are not recorded. Nothing is recorded when RecordKeys is empty.
+	RecordKeys []string
+	Version    int
+}
 
-	tx, err := db.Begin()
+// WriteCsvToDb streams the CSV rows into the database using PostgreSQL COPY
+// command and returns the number of rows copied. The rows are appended, or
+// replace, upsert or sync the rows of the table depending on the load mode.
+// Everything runs inside tx; committing or rolling it back is left to the
+// caller.
+func WriteCsvToDb(ctx context.Context, tx *sql.Tx, csv *csv.Stream, table Table, opts LoadOptions) (int64, error) {
+	// Run the pre SQL before the COPY
+	if opts.Pre != "" {
+		_, err := tx.ExecContext(ctx, opts.Pre)
+		if err != nil {
+			return 0, fmt.Errorf("an error occurred while running the pre SQL: %w", err)
+		}
+	}
+
+	var rows int64
+	var err error
+	switch opts.Mode {
+	case "", dm.ModeAppend:
+		rows, err = insertCsv(ctx, tx, csv, table, opts)
+	case dm.ModeReplace:
+		err = TruncateTableTx(ctx, tx, table)
+		if err != nil {
+			return 0, fmt.Errorf("an error occurred while truncating table %s: %w", table, err)
+		}
+		rows, err = insertCsv(ctx, tx, csv, table, opts)
+	case dm.ModeUpsert, dm.ModeSync:
+		rows, err = mergeCsv(ctx, tx, csv, table, opts)
+	default:
+		return 0, fmt.Errorf("unknown load mode %q", opts.Mode)
+	}
 	if err != nil {
-		return err
+		return 0, err
 	}
-	totalRows := len(csv.Rows)
-	bar := progressbar.Default(int64(totalRows), "Copying CSV to database")
+
+	// Run the post SQL after the COPY
+	if opts.Post != "" {
+		_, err = tx.ExecContext(ctx, opts.Post)
+		if err != nil {
+			return 0, fmt.Errorf("an error occurred while running the post SQL: %w", err)
+		}
+	}
+
+	return rows, nil
+}
+
+// copyCsv copies the CSV rows into the table and returns the number of rows
+// copied.
+func copyCsv(ctx context.Context, tx *sql.Tx, csv *csv.Stream, table Table) (int64, error) {
 	// Prepare the COPY statement
-	stmt, err := tx.Prepare(pq.CopyIn(tableName, csv.Columns...))
+	columns := csv.TableColumns()
+	stmt, err := tx.PrepareContext(ctx, table.copyIn(columns))
 	if err != nil {
-		tx.Rollback()
-		return err
+		return 0, err
 	}
-	defer stmt.Close()
 
 	// Iterate over the rows and execute the COPY statement
-	for _, row := range csv.Rows {
-		values := make([]interface{}, len(row.Values))
+	var rows int64
+	values := make([]interface{}, len(columns))
+	for csv.Next() {
+		row := csv.Row()
+		if len(row.Values) != len(columns) {
+			stmt.Close()
+			return 0, fmt.Errorf("%s:%d: expected %d fields, got %d", csv.Path, row.Line, len(columns), len(row.Values))
+		}
 		for i, v := range row.Values {
+			if row.IsNull(i) {
+				values[i] = nil
+				continue
+			}
 			values[i] = v
 		}
 
-		_, err = stmt.Exec(values...)
+		_, err = stmt.ExecContext(ctx, values...)
 		if err != nil {
-			tx.Rollback()
-			return err
+			stmt.Close()
+			return 0, err
 		}
-		bar.Add(1)
+		rows++
+	}
+	if err = csv.Err(); err != nil {
+		stmt.Close()
+		return 0, err
 	}
 
 	// Signal completion of COPY
-	_, err = stmt.Exec()
+	_, err = stmt.ExecContext(ctx)
 	if err != nil {
-		tx.Rollback()
-		return err
+		stmt.Close()
+		return 0, err
 	}
-
-	// Commit the transaction
-	if err = tx.Commit(); err != nil {
-		return err
+	if err = stmt.Close(); err != nil {
+		return 0, err
 	}
-
-	return nil
+	return rows, nil
 }
 
-func GetVersion(db *sql.DB) (uint, error) {
+func GetVersion(ctx context.Context, db *sql.DB) (uint, error) {
 	// Get the current version from the data migration table
-	err := db.Ping()
+	err := db.PingContext(ctx)
 	if err != nil {
 		return 0, err
 	}
 
 	var version uint
-	err = db.QueryRow(`SELECT version FROM schema_datamigrations ORDER BY version DESC LIMIT 1;`).Scan(&version)
+	err = db.QueryRowContext(ctx, `SELECT version FROM schema_datamigrations ORDER BY version DESC LIMIT 1;`).Scan(&version)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			// No rows means no migrations have been run yet
@@ -156,52 +231,54 @@ func GetVersion(db *sql.DB) (uint, error) {
 	return version, nil
 }
 
-func SetVersion(db *sql.DB, version int) error {
+func SetVersion(ctx context.Context, db *sql.DB, version int) error {
 	// Ensure the database connection is alive
-	err := db.Ping()
+	err := db.PingContext(ctx)
 	if err != nil {
 		return err
 	}
-	// Truncate the table
-	_, err = db.Exec(`TRUNCATE TABLE schema_datamigrations;`)
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-
-	// Perform the insert operation
-	_, err = db.Exec(`
-        INSERT INTO schema_datamigrations (version, dirty) 
-        VALUES ($1, false);
-    `, version)
+	err = SetVersionTx(ctx, tx, version, false)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
-func RemoveVersion(db *sql.DB, version int) error {
-	// Remove the version from the data migration table
-	err := db.Ping()
+
+// SetVersionTx replaces the recorded data migration version inside the given
+// transaction, so that it commits or rolls back together with the data.
+func SetVersionTx(ctx context.Context, tx *sql.Tx, version int, dirty bool) error {
+	// Truncate the table
+	_, err := tx.ExecContext(ctx, `TRUNCATE TABLE schema_datamigrations;`)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(`DELETE FROM schema_datamigrations WHERE version = $1;`, version)
+	// Perform the insert operation
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO schema_datamigrations (version, dirty) 
+        VALUES ($1, $2);
+    `, version, dirty)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
-
-func SetDirty(db *sql.DB, version int) error {
-	// Set the dirty flag in the data migration table
-	err := db.Ping()
+func RemoveVersion(ctx context.Context, db *sql.DB, version int) error {
+	// Remove the version from the data migration table
+	err := db.PingContext(ctx)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(`UPDATE schema_datamigrations SET dirty = true WHERE version = $1;`, version)
+	_, err = db.ExecContext(ctx, `DELETE FROM schema_datamigrations WHERE version = $1;`, version)
 	if err != nil {
 		return err
 	}
@@ -209,17 +286,22 @@ func SetDirty(db *sql.DB, version int) error {
 	return nil
 }
 
-func ClearDirty(db *sql.DB, version int) error {
-	// Clear the dirty flag in the data migration table
-	err := db.Ping()
+// GetDirty returns the current data migration version and whether it is dirty.
+func GetDirty(ctx context.Context, db *sql.DB) (uint, bool, error) {
+	err := db.PingContext(ctx)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 
-	_, err = db.Exec(`UPDATE schema_datamigrations SET dirty = false WHERE version = $1;`, version)
+	var version uint
+	var dirty bool
+	err = db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_datamigrations ORDER BY version DESC LIMIT 1;`).Scan(&version, &dirty)
 	if err != nil {
-		return err
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		return 0, false, err
 	}
 
-	return nil
+	return version, dirty, nil
 }
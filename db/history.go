@@ -0,0 +1,183 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The directions a data migration can be run in.
+const (
+	DirectionUp   = "up"
+	DirectionDown = "down"
+)
+
+// HistoryEntry is a single run of a data migration recorded in the
+// schema_datamigrations_history table. Checksum is the SHA-256 of the CSV and
+// YAMLChecksum the SHA-256 of the data migration YAML that were applied.
+// ETag is the ETag of a remote CSV, if its source has one.
+// KeyColumns are the columns recorded for the inserted rows of an up run, nil
+// when they were not recorded.
+type HistoryEntry struct {
+	ID           int64         `json:"id"`
+	Version      int           `json:"version"`
+	Direction    string        `json:"direction"`
+	Checksum     string        `json:"checksum"`
+	YAMLChecksum string        `json:"yaml_checksum"`
+	ETag         string        `json:"etag,omitempty"`
+	KeyColumns   []string      `json:"key_columns,omitempty"`
+	Rows         int64         `json:"rows"`
+	Duration     time.Duration `json:"duration"`
+	AppliedAt    time.Time     `json:"applied_at"`
+	Hostname     string        `json:"hostname"`
+	User         string        `json:"user"`
+}
+
+func CreateHistoryTable(ctx context.Context, db *sql.DB) error {
+	// Create the data migration history table
+	err := db.PingContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_datamigrations_history (
+			id bigserial PRIMARY KEY,
+			version bigint NOT NULL,
+			direction text NOT NULL,
+			checksum text NOT NULL DEFAULT '',
+			row_count bigint NOT NULL DEFAULT 0,
+			duration_ms bigint NOT NULL DEFAULT 0,
+			applied_at timestamptz NOT NULL DEFAULT now(),
+			hostname text NOT NULL DEFAULT '',
+			username text NOT NULL DEFAULT '',
+			yaml_checksum text NOT NULL DEFAULT ''
+		);`)
+	if err != nil {
+		return err
+	}
+
+	// history tables created before yaml checksums, key columns and etags
+	// were recorded
+	_, err = db.ExecContext(ctx, `
+		ALTER TABLE schema_datamigrations_history
+			ADD COLUMN IF NOT EXISTS yaml_checksum text NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS key_columns text[],
+			ADD COLUMN IF NOT EXISTS etag text NOT NULL DEFAULT '';`)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func CheckHistoryTableExists(ctx context.Context, db *sql.DB) bool {
+	// Check if the data migration history table exists
+	err := db.PingContext(ctx)
+	if err != nil {
+		return false
+	}
+
+	_, err = db.ExecContext(ctx, `SELECT 1 FROM schema_datamigrations_history LIMIT 1;`)
+	return err == nil
+}
+
+// InsertHistoryTx records a data migration run inside the given transaction,
+// so that the history only holds runs that were committed.
+func InsertHistoryTx(ctx context.Context, tx *sql.Tx, entry HistoryEntry) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO schema_datamigrations_history
+			(version, direction, checksum, yaml_checksum, etag, key_columns, row_count, duration_ms, hostname, username)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);`,
+		entry.Version, entry.Direction, entry.Checksum, entry.YAMLChecksum, entry.ETag, pq.Array(entry.KeyColumns), entry.Rows,
+		entry.Duration.Milliseconds(), entry.Hostname, entry.User)
+	return err
+}
+
+// GetHistory returns every recorded data migration run, oldest first.
+func GetHistory(ctx context.Context, db *sql.DB) ([]HistoryEntry, error) {
+	err := db.PingContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, version, direction, checksum, yaml_checksum, etag, key_columns, row_count, duration_ms, applied_at, hostname, username
+		FROM schema_datamigrations_history
+		ORDER BY id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []HistoryEntry{}
+	for rows.Next() {
+		var entry HistoryEntry
+		var durationMs int64
+		err = rows.Scan(&entry.ID, &entry.Version, &entry.Direction, &entry.Checksum, &entry.YAMLChecksum, &entry.ETag, pq.Array(&entry.KeyColumns), &entry.Rows,
+			&durationMs, &entry.AppliedAt, &entry.Hostname, &entry.User)
+		if err != nil {
+			return nil, err
+		}
+		entry.Duration = time.Duration(durationMs) * time.Millisecond
+		history = append(history, entry)
+	}
+
+	return history, rows.Err()
+}
+
+// GetAppliedChecksums returns, for every version whose latest run was an up
+// run, the history entry of that run. It is used to detect data migrations
+// whose files changed after they were applied.
+func GetAppliedChecksums(ctx context.Context, db *sql.DB) (map[int]HistoryEntry, error) {
+	err := db.PingContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, appliedQuery+` ORDER BY version, id DESC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]HistoryEntry{}
+	for rows.Next() {
+		entry, err := scanApplied(rows)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Direction == DirectionUp {
+			applied[entry.Version] = entry
+		}
+	}
+
+	return applied, rows.Err()
+}
+
+// GetAppliedEntryTx returns the history entry of the run that applied version,
+// read inside the given transaction. It reports false when the latest run of
+// the version is not an up run.
+func GetAppliedEntryTx(ctx context.Context, tx *sql.Tx, version int) (HistoryEntry, bool, error) {
+	entry, err := scanApplied(tx.QueryRowContext(ctx, appliedQuery+` WHERE version = $1 ORDER BY version, id DESC;`, version))
+	if err == sql.ErrNoRows {
+		return HistoryEntry{}, false, nil
+	}
+	if err != nil {
+		return HistoryEntry{}, false, err
+	}
+	return entry, entry.Direction == DirectionUp, nil
+}
+
+// appliedQuery selects the latest run of every version.
+const appliedQuery = `
+		SELECT DISTINCT ON (version) version, direction, checksum, yaml_checksum, etag, key_columns, row_count
+		FROM schema_datamigrations_history`
+
+func scanApplied(row interface{ Scan(...any) error }) (HistoryEntry, error) {
+	var entry HistoryEntry
+	err := row.Scan(&entry.Version, &entry.Direction, &entry.Checksum, &entry.YAMLChecksum, &entry.ETag, pq.Array(&entry.KeyColumns), &entry.Rows)
+	return entry, err
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"strings"
+
+	dm "github.com/datamigrate/migration"
+	"github.com/lib/pq"
+)
+
+// Table identifies a table, optionally qualified by its schema. Names are
+// used as is, without case folding, and are always quoted in SQL.
+type Table struct {
+	Schema string
+	Name   string
+}
+
+// TableFor returns the table a data migration loads into.
+func TableFor(m *dm.MigrationDDL) Table {
+	schema, name := m.QualifiedTable()
+	return Table{Schema: schema, Name: name}
+}
+
+// Identifier returns the quoted, schema-qualified identifier of the table.
+func (t Table) Identifier() string {
+	if t.Schema == "" {
+		return pq.QuoteIdentifier(t.Name)
+	}
+	return pq.QuoteIdentifier(t.Schema) + "." + pq.QuoteIdentifier(t.Name)
+}
+
+// String returns the unquoted name of the table, for messages.
+func (t Table) String() string {
+	if t.Schema == "" {
+		return t.Name
+	}
+	return t.Schema + "." + t.Name
+}
+
+// copyIn returns the COPY statement loading the columns of the table.
+func (t Table) copyIn(columns []string) string {
+	if t.Schema == "" {
+		return pq.CopyIn(t.Name, columns...)
+	}
+	return pq.CopyInSchema(t.Schema, t.Name, columns...)
+}
+
+// quoteColumns returns the quoted column names, separated by commas.
+func quoteColumns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, col := range columns {
+		quoted[i] = pq.QuoteIdentifier(col)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// CreateKeysTable creates the table recording the keys of the rows each data
+// migration inserted, so that reverting it deletes exactly those rows.
+func CreateKeysTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_datamigrations_keys (
+			version bigint NOT NULL,
+			key jsonb NOT NULL,
+			CONSTRAINT schema_datamigrations_keys_pkey PRIMARY KEY (version, key)
+		);`)
+	return err
+}
+
+// KeyColumns returns the key columns of a data migration: the given keys, or
+// else the primary key of the table. It returns no columns for a table
+// without a primary key.
+func KeyColumns(ctx context.Context, tx *sql.Tx, table Table, keys []string) ([]string, error) {
+	if len(keys) > 0 {
+		return keys, nil
+	}
+	keys, err := PrimaryKey(ctx, tx, table)
+	if err != nil {
+		return nil, fmt.Errorf("an error occurred while reading the primary key of %s: %w", table, err)
+	}
+	return keys, nil
+}
+
+// recordInserted wraps an INSERT into the table, aliased t, so that the keys
+// of the rows it inserted are recorded under version. The INSERT must return
+// the keys as key and, for an upsert, whether the row was inserted as
+// inserted.
+func recordInserted(insert string, upsert bool) string {
+	where := ""
+	if upsert {
+		where = " WHERE inserted"
+	}
+	return fmt.Sprintf(`WITH loaded AS (%s) INSERT INTO schema_datamigrations_keys (version, key) SELECT $1, key FROM loaded%s ON CONFLICT DO NOTHING;`,
+		insert, where)
+}
+
+// keyObject returns the JSON object of the key columns of a row of the table,
+// aliased t.
+func keyObject(keys []string) string {
+	var fields []string
+	for _, key := range keys {
+		fields = append(fields, fmt.Sprintf("%s, t.%s", pq.QuoteLiteral(key), pq.QuoteIdentifier(key)))
+	}
+	return "jsonb_build_object(" + strings.Join(fields, ", ") + ")"
+}
+
+// DeleteInsertedRows deletes the rows of the table a data migration version
+// inserted, matched on the recorded values of the given key columns, and
+// forgets them. It returns the number of rows deleted.
+func DeleteInsertedRows(ctx context.Context, tx *sql.Tx, table Table, version int, keys []string) (int64, error) {
+	result, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s AS t USING schema_datamigrations_keys AS k WHERE k.version = $1 AND k.key = %s;`,
+		table.Identifier(), keyObject(keys)), version)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM schema_datamigrations_keys WHERE version = $1;`, version)
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
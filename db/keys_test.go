@@ -0,0 +1,75 @@
+package db
+
+import "testing"
+
+func TestKeyObject(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+		want string
+	}{
+		{"single", []string{"id"}, `jsonb_build_object('id', t."id")`},
+		{"mixed case", []string{"UserID"}, `jsonb_build_object('UserID', t."UserID")`},
+		{"quotes", []string{`a"b`, "it's"}, `jsonb_build_object('a"b', t."a""b", 'it''s', t."it's")`},
+		{"composite", []string{"tenant_id", "Code"}, `jsonb_build_object('tenant_id', t."tenant_id", 'Code', t."Code")`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keyObject(tt.keys); got != tt.want {
+				t.Errorf("keyObject(%q) =\n%s\nwant\n%s", tt.keys, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+		want string
+	}{
+		{"single", []string{"id"}, `l."id" = t."id"`},
+		{"mixed case", []string{"UserID"}, `l."UserID" = t."UserID"`},
+		{"quotes", []string{`a"b`}, `l."a""b" = t."a""b"`},
+		{"composite", []string{"tenant_id", "Code"}, `l."tenant_id" = t."tenant_id" AND l."Code" = t."Code"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchKeys(tt.keys); got != tt.want {
+				t.Errorf("matchKeys(%q) =\n%s\nwant\n%s", tt.keys, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordInserted(t *testing.T) {
+	insert := `INSERT INTO "Users" AS t ("id") SELECT "id" FROM "datamigrate_load" RETURNING ` + keyObject([]string{"id"}) + ` AS key`
+	want := `WITH loaded AS (` + insert + `) INSERT INTO schema_datamigrations_keys (version, key) SELECT $1, key FROM loaded ON CONFLICT DO NOTHING;`
+	if got := recordInserted(insert, false); got != want {
+		t.Errorf("recordInserted(insert) =\n%s\nwant\n%s", got, want)
+	}
+
+	want = `WITH loaded AS (` + insert + `) INSERT INTO schema_datamigrations_keys (version, key) SELECT $1, key FROM loaded WHERE inserted ON CONFLICT DO NOTHING;`
+	if got := recordInserted(insert, true); got != want {
+		t.Errorf("recordInserted(upsert) =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTableIdentifier(t *testing.T) {
+	tests := []struct {
+		table Table
+		want  string
+	}{
+		{Table{Name: "users"}, `"users"`},
+		{Table{Schema: "Sales", Name: "Orders"}, `"Sales"."Orders"`},
+		{Table{Name: `we"ird`}, `"we""ird"`},
+	}
+	for _, tt := range tests {
+		if got := tt.table.Identifier(); got != tt.want {
+			t.Errorf("Identifier(%+v) = %s, want %s", tt.table, got, tt.want)
+		}
+	}
+	if got, want := quoteColumns([]string{"id", "Name", `a"b`}), `"id", "Name", "a""b"`; got != want {
+		t.Errorf("quoteColumns = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,27 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// lockName identifies the advisory lock taken while data migrations run.
+const lockName = "schema_datamigrations"
+
+// TryLock tries to take the data migration advisory lock on the session of
+// conn, without waiting. It reports whether the lock was taken.
+func TryLock(ctx context.Context, conn *sql.Conn) (bool, error) {
+	var locked bool
+	err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(hashtext($1));`, lockName).Scan(&locked)
+	if err != nil {
+		return false, err
+	}
+	return locked, nil
+}
+
+// Unlock releases the data migration advisory lock held by the session of
+// conn.
+func Unlock(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock(hashtext($1));`, lockName)
+	return err
+}
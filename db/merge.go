@@ -0,0 +1,193 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/datamigrate/csv"
+	dm "github.com/datamigrate/migration"
+	"github.com/lib/pq"
+)
+
+// loadTable is the temporary table the upsert and sync modes copy into.
+var loadTable = Table{Name: "datamigrate_load"}
+
+// PrimaryKey returns the primary key columns of the table, in key order.
+func PrimaryKey(ctx context.Context, tx *sql.Tx, table Table) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT a.attname
+		FROM pg_index i
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = $1::regclass AND i.indisprimary
+		ORDER BY array_position(i.indkey::int2[], a.attnum);`, table.Identifier())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// insertCsv copies the CSV rows into the table. When keys are recorded, the
+// rows go through the load table so that the keys of the inserted rows,
+// generated ones included, can be returned.
+func insertCsv(ctx context.Context, tx *sql.Tx, csv *csv.Stream, table Table, opts LoadOptions) (int64, error) {
+	if len(opts.RecordKeys) == 0 {
+		return copyCsv(ctx, tx, csv, table)
+	}
+	columns := csv.TableColumns()
+	rows, err := copyToLoadTable(ctx, tx, csv, table)
+	if err != nil {
+		return 0, err
+	}
+	insert := fmt.Sprintf(`INSERT INTO %s AS t (%s) SELECT %s FROM %s RETURNING %s AS key`,
+		table.Identifier(), quoteColumns(columns), quoteColumns(columns), loadTable.Identifier(), keyObject(opts.RecordKeys))
+	_, err = tx.ExecContext(ctx, recordInserted(insert, false), opts.Version)
+	if err != nil {
+		return 0, fmt.Errorf("an error occurred while inserting into %s: %w", table, err)
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`DROP TABLE %s;`, loadTable.Identifier()))
+	if err != nil {
+		return 0, err
+	}
+	return rows, nil
+}
+
+// mergeCsv copies the CSV rows into a temporary table and upserts them into
+// the table on the key columns. In the sync mode, the rows of the table whose
+// keys are not in the CSV are deleted, so that the table matches it.
+func mergeCsv(ctx context.Context, tx *sql.Tx, csv *csv.Stream, table Table, opts LoadOptions) (int64, error) {
+	columns := csv.TableColumns()
+	keys, err := resolveKeys(ctx, tx, table, opts.Keys, columns)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := copyToLoadTable(ctx, tx, csv, table)
+	if err != nil {
+		return 0, err
+	}
+
+	var updates []string
+	for _, col := range columns {
+		if !slices.Contains(keys, col) {
+			quoted := pq.QuoteIdentifier(col)
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", quoted, quoted))
+		}
+	}
+	conflict := "DO NOTHING"
+	if len(updates) > 0 {
+		conflict = "DO UPDATE SET " + strings.Join(updates, ", ")
+	}
+	upsert := fmt.Sprintf(`INSERT INTO %s AS t (%s) SELECT %s FROM %s ON CONFLICT (%s) %s`,
+		table.Identifier(), quoteColumns(columns), quoteColumns(columns), loadTable.Identifier(), quoteColumns(keys), conflict)
+	if len(opts.RecordKeys) > 0 {
+		// xmax is only set on the rows the upsert updated
+		upsert += fmt.Sprintf(` RETURNING %s AS key, t.xmax = 0 AS inserted`, keyObject(opts.RecordKeys))
+		_, err = tx.ExecContext(ctx, recordInserted(upsert, true), opts.Version)
+	} else {
+		_, err = tx.ExecContext(ctx, upsert+";")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("an error occurred while upserting into %s: %w", table, err)
+	}
+
+	if opts.Mode == dm.ModeSync {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s AS t WHERE NOT EXISTS (SELECT 1 FROM %s AS l WHERE %s);`,
+			table.Identifier(), loadTable.Identifier(), matchKeys(keys)))
+		if err != nil {
+			return 0, fmt.Errorf("an error occurred while deleting the rows missing from the csv from %s: %w", table, err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`DROP TABLE %s;`, loadTable.Identifier()))
+	if err != nil {
+		return 0, err
+	}
+	return rows, nil
+}
+
+// DeleteCsvFromDb deletes the rows of the table whose keys are in the CSV and
+// returns the number of rows deleted. The keys default to the primary key of
+// the table.
+func DeleteCsvFromDb(ctx context.Context, tx *sql.Tx, csv *csv.Stream, table Table, keys []string) (int64, error) {
+	keys, err := resolveKeys(ctx, tx, table, keys, csv.TableColumns())
+	if err != nil {
+		return 0, err
+	}
+	_, err = copyToLoadTable(ctx, tx, csv, table)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s AS t USING %s AS l WHERE %s;`,
+		table.Identifier(), loadTable.Identifier(), matchKeys(keys)))
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`DROP TABLE %s;`, loadTable.Identifier()))
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// resolveKeys returns the key columns, defaulting to the primary key of the
+// table, and checks that they are all loaded from the CSV.
+func resolveKeys(ctx context.Context, tx *sql.Tx, table Table, keys []string, columns []string) ([]string, error) {
+	if len(keys) == 0 {
+		var err error
+		keys, err = PrimaryKey(ctx, tx, table)
+		if err != nil {
+			return nil, fmt.Errorf("an error occurred while reading the primary key of %s: %w", table, err)
+		}
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("the table %s has no primary key: set the keys of the data migration", table)
+		}
+	}
+	for _, key := range keys {
+		if !slices.Contains(columns, key) {
+			return nil, fmt.Errorf("the key column %s is not loaded from the csv", key)
+		}
+	}
+	return keys, nil
+}
+
+// copyToLoadTable creates the temporary load table and copies the CSV rows
+// into it. The load table only has the loaded columns, so that the columns
+// left out keep their defaults in the table.
+func copyToLoadTable(ctx context.Context, tx *sql.Tx, csv *csv.Stream, table Table) (int64, error) {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`CREATE TEMP TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA;`,
+		loadTable.Identifier(), quoteColumns(csv.TableColumns()), table.Identifier()))
+	if err != nil {
+		return 0, fmt.Errorf("an error occurred while creating the load table: %w", err)
+	}
+	return copyCsv(ctx, tx, csv, loadTable)
+}
+
+// matchKeys returns the condition matching the rows of the table, aliased t,
+// to the rows of the load table, aliased l.
+func matchKeys(keys []string) string {
+	var match []string
+	for _, key := range keys {
+		quoted := pq.QuoteIdentifier(key)
+		match = append(match, fmt.Sprintf("l.%s = t.%s", quoted, quoted))
+	}
+	return strings.Join(match, " AND ")
+}
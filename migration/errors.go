@@ -0,0 +1,118 @@
+package migration
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sentinel errors that callers can match with errors.Is. The error types below
+// match their sentinel, and carry the details for errors.As.
+var (
+	ErrParse          = errors.New("parse error")
+	ErrNotFound       = errors.New("data migration not found")
+	ErrMissingCSV     = errors.New("csv file does not exist")
+	ErrColumnMismatch = errors.New("csv columns are missing columns of the migration")
+	ErrDirty          = errors.New("data migration version is dirty")
+	ErrDrift          = errors.New("applied data migration has changed")
+	ErrInvalidValue   = errors.New("csv value does not match the column type")
+	ErrTooManyRejects = errors.New("too many rows were rejected")
+	ErrNoKeys         = errors.New("the rows of the data migration cannot be told apart without keys")
+)
+
+// ParseError is returned when a migration file, a data migration YAML or a
+// version cannot be parsed.
+type ParseError struct {
+	Path string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("parse error: %v", e.Err)
+	}
+	return fmt.Sprintf("an error occurred while parsing %s: %v", e.Path, e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+func (e *ParseError) Is(target error) bool { return target == ErrParse }
+
+// NotFoundError is returned when no data migration exists for a version.
+type NotFoundError struct {
+	Version int
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("data migration with version %d not found", e.Version)
+}
+
+func (e *NotFoundError) Is(target error) bool { return target == ErrNotFound }
+
+// MissingCSVError is returned when the csv_path of a data migration does not
+// point to an existing file.
+type MissingCSVError struct {
+	Path string
+}
+
+func (e *MissingCSVError) Error() string {
+	return fmt.Sprintf("the csv file %s does not exist", e.Path)
+}
+
+func (e *MissingCSVError) Is(target error) bool { return target == ErrMissingCSV }
+
+// ColumnMismatchError is returned when the CSV header has no column for some
+// of the columns of the data migration.
+type ColumnMismatchError struct {
+	CSVColumns       []string
+	MigrationColumns []string
+	Missing          []string
+}
+
+func (e *ColumnMismatchError) Error() string {
+	return fmt.Sprintf("CSV Columns do not contain the columns [%s] of the migration. CSV Columns: [%s], Migration Columns: [%s]",
+		strings.Join(e.Missing, " "), strings.Join(e.CSVColumns, " "), strings.Join(e.MigrationColumns, " "))
+}
+
+func (e *ColumnMismatchError) Is(target error) bool { return target == ErrColumnMismatch }
+
+// DirtyError is returned when the data migration table is flagged dirty. Loads
+// commit together with their version, so only older releases, which flagged a
+// version dirty before loading it, or manual edits leave it so.
+type DirtyError struct {
+	Version uint
+}
+
+func (e *DirtyError) Error() string {
+	return fmt.Sprintf("the current data migration version %d is dirty. Please fix state and run 'datamigrate force <version>' to continue", e.Version)
+}
+
+func (e *DirtyError) Is(target error) bool { return target == ErrDirty }
+
+// DriftError is returned when applied data migrations have changed since they
+// were applied.
+type DriftError struct {
+	Versions []int
+}
+
+func (e *DriftError) Error() string {
+	return fmt.Sprintf("data migrations %v have changed since they were applied", e.Versions)
+}
+
+func (e *DriftError) Is(target error) bool { return target == ErrDrift }
+
+// TooManyRejectsError is returned when a data migration rejects more rows than
+// its max_errors allows.
+type TooManyRejectsError struct {
+	Rejected    int64
+	Total       int64
+	MaxErrors   string
+	RejectsPath string
+}
+
+func (e *TooManyRejectsError) Error() string {
+	return fmt.Sprintf("%d of %d rows were rejected, more than max_errors %s allows. The rejected rows are in %s",
+		e.Rejected, e.Total, e.MaxErrors, e.RejectsPath)
+}
+
+func (e *TooManyRejectsError) Is(target error) bool { return target == ErrTooManyRejects }
@@ -1,17 +1,26 @@
 package migration
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/auxten/postgresql-parser/pkg/sql/parser"
 	"github.com/auxten/postgresql-parser/pkg/sql/sem/tree"
 	"github.com/auxten/postgresql-parser/pkg/walk"
+	"github.com/golang-migrate/migrate/v4/source"
 	"gopkg.in/yaml.v2"
 )
 
@@ -27,27 +36,285 @@ type Migration struct {
 	Name          string
 	MigrationType MigrationType
 	Path          string
+	// SQL is the content of a migration read from a golang-migrate source
+	// driver. Migrations found on disk are read from Path instead.
+	SQL []byte
 }
 
 type DataMigration struct {
 	Migration *Migration
 
 	Path string
+	// CSVPath is the csv_path written to the data migration, when known. It
+	// may be compressed, e.g. data/users.csv.gz.
+	CSVPath string
 }
 
+// The load modes of a data migration.
+const (
+	// ModeAppend copies the rows into the table.
+	ModeAppend = "append"
+	// ModeReplace truncates the table, then copies the rows into it.
+	ModeReplace = "replace"
+	// ModeUpsert inserts the rows, updating the existing rows with the same
+	// keys.
+	ModeUpsert = "upsert"
+	// ModeSync upserts the rows and deletes the rows whose keys are not in
+	// the CSV.
+	ModeSync = "sync"
+)
+
+// The down strategies of a data migration without down SQL.
+const (
+	// StrategyDelete deletes the rows the data migration inserted, by their
+	// recorded keys or else by the keys in its unchanged CSV. Rows an upsert
+	// or sync only updated keep their new values, and rows a sync deleted are
+	// not restored. A table without keys cannot be reverted this way.
+	StrategyDelete = "delete"
+	// StrategyTruncate truncates the table.
+	StrategyTruncate = "truncate"
+)
+
+// The formats of the file a data migration loads.
+const (
+	// FormatCSV is a CSV file with a header.
+	FormatCSV = "csv"
+	// FormatJSON is a JSON array of objects.
+	FormatJSON = "json"
+	// FormatNDJSON is newline-delimited JSON, one object per line.
+	FormatNDJSON = "ndjson"
+)
+
 type Column struct {
 	Name string `yaml:"name"`
 	Type string `yaml:"type"`
+	// CSV is the header of the CSV column loaded into this column, when it
+	// differs from the column name. For JSON it is the key of the value, or
+	// a dotted path such as address.city to flatten a nested object.
+	CSV string `yaml:"csv,omitempty"`
+	// Null overrides the null marker of the data migration for this column.
+	Null *string `yaml:"null_marker,omitempty"`
 }
 
 type MigrationDDL struct {
-	Version   string   `yaml:"version"`
-	CSVPath   string   `yaml:"csv_path"`
-	Delimiter string   `yaml:"delimiter"`
-	Pre       string   `yaml:"pre"`
-	Post      string   `yaml:"post"`
-	Table     string   `yaml:"table_name"`
-	Columns   []Column `yaml:"columns"`
+	Version string `yaml:"version"`
+	// CSVPath is a local path or a URL, such as s3://bucket/key, read with
+	// the csv source registered for its scheme.
+	CSVPath string `yaml:"csv_path"`
+	// FileFormat is the format of the file at CSVPath: csv, the default, json
+	// or ndjson. The keys of JSON objects are mapped to the columns like CSV
+	// headers; nested objects and arrays are loaded as JSON text.
+	FileFormat string `yaml:"format,omitempty"`
+	Delimiter  string `yaml:"delimiter"`
+	// Quote and Escape configure how fields are quoted in the CSV. They
+	// default to RFC 4180: double quotes, escaped by doubling them.
+	Quote  string `yaml:"quote,omitempty"`
+	Escape string `yaml:"escape,omitempty"`
+	Pre    string `yaml:"pre"`
+	Post   string `yaml:"post"`
+	// Schema qualifies the table. A table_name of the form schema.table is
+	// also accepted.
+	Schema  string   `yaml:"schema,omitempty"`
+	Table   string   `yaml:"table_name"`
+	Columns []Column `yaml:"columns"`
+	// Null is the CSV value loaded as NULL, e.g. "", \N or NULL. When it is
+	// not set every value is loaded as is.
+	Null *string `yaml:"null_marker,omitempty"`
+	// DateLayouts are the Go time layouts tried, in order, to read date and
+	// timestamp values. Values that match none of them are loaded as is.
+	DateLayouts []string `yaml:"date_layouts,omitempty"`
+	// ThousandsSeparator is stripped from numbers such as 1,234,567. It
+	// defaults to a comma.
+	ThousandsSeparator string `yaml:"thousands_separator,omitempty"`
+	// MaxErrors enables rejecting invalid rows instead of failing the load.
+	// The rejected rows are written to a .rejects.csv file next to the CSV,
+	// and the load fails only when their count, e.g. 100, or percentage,
+	// e.g. 5%, goes over MaxErrors.
+	MaxErrors string `yaml:"max_errors,omitempty"`
+	// Mode is how the rows are loaded: append, the default, replace, upsert
+	// or sync.
+	Mode string `yaml:"mode,omitempty"`
+	// Keys are the columns matching CSV rows to table rows in the upsert and
+	// sync modes, and the ones the delete strategy reverts by. They default
+	// to the primary key of the table.
+	Keys []string `yaml:"keys,omitempty"`
+	// RecordKeys records the keys of the rows an append or replace load
+	// inserts, as the upsert and sync modes and loads that generate their keys
+	// always do. Without it the delete strategy deletes the keys in the CSV,
+	// which is refused once the CSV has changed. Recording costs a copy
+	// through a temporary table and a row per inserted row in
+	// schema_datamigrations_keys.
+	RecordKeys bool `yaml:"record_keys,omitempty"`
+	// Down is the SQL, or path to a .sql file, that reverts the data
+	// migration.
+	Down string `yaml:"down_sql,omitempty"`
+	// Strategy is how the data migration is reverted when it has no down
+	// SQL: delete, the default, or truncate.
+	Strategy string `yaml:"strategy,omitempty"`
+
+	// Path and Checksum are filled in by ReadMigrationFile: the path of the
+	// YAML file and the SHA-256 of its content.
+	Path     string `yaml:"-"`
+	Checksum string `yaml:"-"`
+	// FS is the file system the data migration was read from by
+	// ReadMigrationFileFS. Its relative csv_path and .sql paths are read from
+	// FS too, other paths from the local file system.
+	FS fs.FS `yaml:"-"`
+}
+
+// PreSQL returns the SQL to run before the data is loaded. The pre field can
+// hold inline SQL or a path to a .sql file.
+func (m MigrationDDL) PreSQL() (string, error) {
+	return m.resolveSQL(m.Pre)
+}
+
+// PostSQL returns the SQL to run after the data is loaded. The post field can
+// hold inline SQL or a path to a .sql file.
+func (m MigrationDDL) PostSQL() (string, error) {
+	return m.resolveSQL(m.Post)
+}
+
+// LoadMode returns the load mode of the data migration.
+func (m MigrationDDL) LoadMode() (string, error) {
+	switch m.Mode {
+	case "":
+		return ModeAppend, nil
+	case ModeAppend, ModeReplace, ModeUpsert, ModeSync:
+		return m.Mode, nil
+	}
+	return "", fmt.Errorf("invalid mode %q: expected one of %s, %s, %s or %s", m.Mode, ModeAppend, ModeReplace, ModeUpsert, ModeSync)
+}
+
+// DataFormat returns the format of the file the data migration loads.
+func (m MigrationDDL) DataFormat() (string, error) {
+	switch m.FileFormat {
+	case "":
+		return FormatCSV, nil
+	case FormatCSV, FormatJSON, FormatNDJSON:
+		return m.FileFormat, nil
+	}
+	return "", fmt.Errorf("invalid format %q: expected one of %s, %s or %s", m.FileFormat, FormatCSV, FormatJSON, FormatNDJSON)
+}
+
+// ErrorLimit is the number or percentage of rows a data migration may reject.
+type ErrorLimit struct {
+	Limit   float64
+	Percent bool
+}
+
+// Exceeded reports whether rejecting rejected rows out of total goes over the
+// limit.
+func (l ErrorLimit) Exceeded(rejected int64, total int64) bool {
+	if l.Percent {
+		return total > 0 && float64(rejected)*100 > l.Limit*float64(total)
+	}
+	return float64(rejected) > l.Limit
+}
+
+// ErrorLimit parses the max_errors of the data migration. It returns nil when
+// max_errors is not set and invalid rows fail the load.
+func (m MigrationDDL) ErrorLimit() (*ErrorLimit, error) {
+	value := strings.TrimSpace(m.MaxErrors)
+	if value == "" {
+		return nil, nil
+	}
+	limit := ErrorLimit{}
+	if strings.HasSuffix(value, "%") {
+		limit.Percent = true
+		value = strings.TrimSpace(strings.TrimSuffix(value, "%"))
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 || (!limit.Percent && n != float64(int64(n))) {
+		return nil, fmt.Errorf("invalid max_errors %q: expected a row count such as 100 or a percentage such as 5%%", m.MaxErrors)
+	}
+	limit.Limit = n
+	return &limit, nil
+}
+
+// Header returns the CSV header of the column.
+func (c Column) Header() string {
+	if c.CSV != "" {
+		return c.CSV
+	}
+	return c.Name
+}
+
+// ColumnByHeader returns the column loaded from the given CSV header.
+func (m MigrationDDL) ColumnByHeader(header string) (Column, bool) {
+	for _, col := range m.Columns {
+		if col.Header() == header {
+			return col, true
+		}
+	}
+	return Column{}, false
+}
+
+// NullMarker returns the value that is loaded as NULL in the given column, or
+// nil if the column has no null marker.
+func (m MigrationDDL) NullMarker(column string) *string {
+	for _, col := range m.Columns {
+		if col.Name == column && col.Null != nil {
+			return col.Null
+		}
+	}
+	return m.Null
+}
+
+// QualifiedTable returns the schema, if any, and the name of the table.
+func (m MigrationDDL) QualifiedTable() (schema string, table string) {
+	if m.Schema == "" {
+		if i := strings.Index(m.Table, "."); i >= 0 {
+			return m.Table[:i], m.Table[i+1:]
+		}
+	}
+	return m.Schema, m.Table
+}
+
+// DownSQL returns the SQL that reverts the data migration, if any. The
+// down_sql field can hold inline SQL or a path to a .sql file.
+func (m MigrationDDL) DownSQL() (string, error) {
+	return m.resolveSQL(m.Down)
+}
+
+// DownStrategy returns how the data migration is reverted when it has no
+// down SQL.
+func (m MigrationDDL) DownStrategy() (string, error) {
+	switch m.Strategy {
+	case "":
+		return StrategyDelete, nil
+	case StrategyDelete, StrategyTruncate:
+		return m.Strategy, nil
+	}
+	return "", fmt.Errorf("invalid strategy %q: expected %s or %s", m.Strategy, StrategyDelete, StrategyTruncate)
+}
+
+func (m MigrationDDL) resolveSQL(stmt string) (string, error) {
+	stmt = strings.TrimSpace(stmt)
+	// a single token ending in .sql is a path to a file, anything else is inline SQL
+	if strings.HasSuffix(strings.ToLower(stmt), ".sql") && !strings.ContainsAny(stmt, " \t\n;") {
+		var buf []byte
+		var err error
+		if name, ok := m.FSName(stmt); ok {
+			buf, err = fs.ReadFile(m.FS, name)
+		} else {
+			buf, err = os.ReadFile(stmt)
+		}
+		if err != nil {
+			return "", fmt.Errorf("an error occurred while reading the sql file %s: %w", stmt, err)
+		}
+		return string(buf), nil
+	}
+	return stmt, nil
+}
+
+// FSName returns the name in FS of a path of the data migration, and whether
+// the path is read from FS: it is relative and the data migration was read
+// from a file system.
+func (m MigrationDDL) FSName(p string) (string, bool) {
+	if m.FS == nil || strings.Contains(p, "://") || filepath.IsAbs(p) {
+		return "", false
+	}
+	return path.Clean(filepath.ToSlash(p)), true
 }
 
 func (m *Migration) GetBasePath() string {
@@ -60,24 +327,45 @@ func ParseVersions(dataMigrations *[]MigrationDDL) ([]int, error) {
 	for _, migration := range *dataMigrations {
 		v, err := strconv.Atoi(migration.Version)
 		if err != nil {
-			return nil, err
+			return nil, &ParseError{Path: migration.Path, Err: err}
 		}
 		versions = append(versions, v)
 	}
+	// directory order is not guaranteed, so always hand back ascending versions
+	sort.Ints(versions)
 	return versions, nil
 }
 
-func GetDataMigrationByVersion(dataMigrations *[]MigrationDDL, version int) *MigrationDDL {
+// PendingVersions splits the sorted data migration versions into those that
+// still need to be applied on top of the current data version and those held
+// back because they are pinned above the current schema version.
+func PendingVersions(versions []int, current int, schemaVersion int) (pending []int, heldBack []int) {
+	for _, v := range versions {
+		if v <= current {
+			continue
+		}
+		if v > schemaVersion {
+			heldBack = append(heldBack, v)
+			continue
+		}
+		pending = append(pending, v)
+	}
+	return pending, heldBack
+}
+
+// GetDataMigrationByVersion returns the data migration with the given
+// version, or a *NotFoundError if there is none.
+func GetDataMigrationByVersion(dataMigrations *[]MigrationDDL, version int) (*MigrationDDL, error) {
 	for _, migration := range *dataMigrations {
 		v, err := strconv.Atoi(migration.Version)
 		if err != nil {
-			log.Fatalf("An error occurred while parsing the version: %v", err)
+			return nil, &ParseError{Path: migration.Path, Err: err}
 		}
 		if v == version {
-			return &migration
+			return &migration, nil
 		}
 	}
-	return nil
+	return nil, &NotFoundError{Version: version}
 }
 
 func GetMigrationVersion(migration *Migration) uint {
@@ -97,16 +385,31 @@ func (m MigrationDDL) Format() string {
 	return result
 }
 
-func ToYaml(migration *Migration) []byte {
+// ToYaml builds the data migration YAML for the CREATE TABLE in the given
+// schema migration.
+func ToYaml(migration *Migration) ([]byte, error) {
+	return toYaml(migration, "")
+}
 
-	buf, err := os.ReadFile(migration.Path)
-	if err != nil {
-		log.Fatalf("An error occurred while reading the migration file: %v", err)
+func toYaml(migration *Migration, csvPath string) ([]byte, error) {
+
+	buf := migration.SQL
+	if buf == nil {
+		var err error
+		buf, err = os.ReadFile(migration.Path)
+		if err != nil {
+			return nil, fmt.Errorf("an error occurred while reading the migration file: %w", err)
+		}
 	}
 	// read to string
 	sql := string(buf)
 
-	var tableName string
+	stmts, err := parser.Parse(sql)
+	if err != nil {
+		return nil, &ParseError{Path: migration.Path, Err: err}
+	}
+
+	var schemaName, tableName string
 	var columns []Column
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -117,11 +420,14 @@ func ToYaml(migration *Migration) []byte {
 			Fn: func(ctx interface{}, node interface{}) (stop bool) {
 				switch n := node.(type) {
 				case *tree.CreateTable:
-					tableName = n.Table.TableName.String()
-					log.Printf("CREATE TABLE %s", tableName)
+					tableName = string(n.Table.TableName)
+					if n.Table.ExplicitSchema {
+						schemaName = string(n.Table.SchemaName)
+					}
+					log.Printf("CREATE TABLE %s", n.Table.String())
 				case *tree.ColumnTableDef:
 					column := Column{
-						Name: n.Name.String(),
+						Name: string(n.Name),
 						Type: n.Type.String(),
 					}
 					columns = append(columns, column)
@@ -131,11 +437,6 @@ func ToYaml(migration *Migration) []byte {
 			},
 		}
 
-		stmts, err := parser.Parse(sql)
-		if err != nil {
-			log.Fatalf("An error occurred while parsing the SQL: %v", err)
-		}
-
 		_, _ = w.Walk(stmts, nil)
 	}()
 
@@ -146,11 +447,14 @@ func ToYaml(migration *Migration) []byte {
 			switch n := node.(type) {
 			case *tree.CreateTable:
 
-				tableName = n.Table.TableName.String()
-				log.Printf("CREATE TABLE %s", tableName)
+				tableName = string(n.Table.TableName)
+				if n.Table.ExplicitSchema {
+					schemaName = string(n.Table.SchemaName)
+				}
+				log.Printf("CREATE TABLE %s", n.Table.String())
 			case *tree.ColumnTableDef:
 				column := Column{
-					Name: n.Name.String(),
+					Name: string(n.Name),
 					Type: n.Type.String(),
 				}
 				// if the column is not already in the columns array, then append it
@@ -167,43 +471,33 @@ func ToYaml(migration *Migration) []byte {
 		},
 	}
 
-	stmts, err := parser.Parse(sql)
-	if err != nil {
-		log.Fatalf("An error occurred while parsing the SQL: %v", err)
-	}
-
 	_, _ = w.Walk(stmts, nil)
 	log.Println("Table Name: ", tableName)
 
 	m := MigrationDDL{
 		Version:   migration.Version,
-		CSVPath:   "",
+		CSVPath:   csvPath,
 		Delimiter: ",",
+		Schema:    schemaName,
 		Table:     tableName,
 		Columns:   columns,
 	}
 
 	yaml, err := yaml.Marshal(m)
 	if err != nil {
-		log.Fatalf("An error occurred while marshalling the migration to yaml: %v", err)
+		return nil, fmt.Errorf("an error occurred while marshalling the migration to yaml: %w", err)
 	}
 	log.Println(string(yaml))
 
-	return yaml
+	return yaml, nil
 
 }
 
-func ReadDataMigrations(migrationsDirPath string) (*[]MigrationDDL, error) {
-	// open the directory
-	dir, err := os.Open(migrationsDirPath)
-
-	if err != nil {
-		return nil, err
-	}
-	defer dir.Close()
-
+// ReadDataMigrations reads the data migrations, the .yml and .yaml files, in a
+// directory. When stat is set, it checks that their CSVs exist.
+func ReadDataMigrations(migrationsDirPath string, stat StatFunc) (*[]MigrationDDL, error) {
 	// read the files in the directory
-	files, err := dir.Readdir(0)
+	files, err := os.ReadDir(migrationsDirPath)
 	if err != nil {
 		return nil, err
 	}
@@ -211,49 +505,110 @@ func ReadDataMigrations(migrationsDirPath string) (*[]MigrationDDL, error) {
 	// parse the files
 	var migrations []MigrationDDL
 	for _, file := range files {
-		if file.IsDir() {
+		if file.IsDir() || !isYAML(file.Name()) {
 			continue
 		}
 		// read the file
 		path := filepath.Join(migrationsDirPath, file.Name())
 
-		migration, err := ReadMigrationFile(path)
+		migration, err := ReadMigrationFile(path, stat)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, *migration)
+	}
+	return &migrations, nil
+
+}
+
+// ReadDataMigrationsFS reads the .yml and .yaml data migrations at the root of
+// fsys, such as an embed.FS narrowed with fs.Sub. Their Path is their name in
+// fsys. When stat is set, it checks that their CSVs exist.
+func ReadDataMigrationsFS(fsys fs.FS, stat StatFunc) (*[]MigrationDDL, error) {
+	files, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []MigrationDDL
+	for _, file := range files {
+		if file.IsDir() || !isYAML(file.Name()) {
+			continue
+		}
+		migration, err := ReadMigrationFileFS(fsys, file.Name(), stat)
 		if err != nil {
 			return nil, err
 		}
 		migrations = append(migrations, *migration)
 	}
 	return &migrations, nil
+}
 
+// isYAML reports whether name is a data migration file, skipping the CSVs and
+// other files that may sit next to them.
+func isYAML(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".yml" || ext == ".yaml"
 }
 
-func ReadMigrationFile(path string) (*MigrationDDL, error) {
+// StatFunc checks that the CSV at a csv_path exists and returns a
+// *MissingCSVError when it does not, such as csv.Exists.
+type StatFunc func(path string) error
+
+func ReadMigrationFile(path string, stat StatFunc) (*MigrationDDL, error) {
 
 	// Read the file
-	file, err := os.Open(path)
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseMigrationFile(buf, path, nil, stat)
+}
 
+// ReadMigrationFileFS reads the data migration file name from fsys.
+func ReadMigrationFileFS(fsys fs.FS, name string, stat StatFunc) (*MigrationDDL, error) {
+	buf, err := fs.ReadFile(fsys, name)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	return parseMigrationFile(buf, name, fsys, stat)
+}
 
+func parseMigrationFile(buf []byte, path string, fsys fs.FS, stat StatFunc) (*MigrationDDL, error) {
 	// Parse the yaml
 	var migration MigrationDDL
-	decoder := yaml.NewDecoder(file)
-	err = decoder.Decode(&migration)
+	err := yaml.Unmarshal(buf, &migration)
 	if err != nil {
-		return nil, err
+		return nil, &ParseError{Path: path, Err: err}
 	}
+	migration.Path = path
+	migration.FS = fsys
+	if _, err := migration.ErrorLimit(); err != nil {
+		return nil, &ParseError{Path: path, Err: err}
+	}
+	if _, err := migration.LoadMode(); err != nil {
+		return nil, &ParseError{Path: path, Err: err}
+	}
+	if _, err := migration.DataFormat(); err != nil {
+		return nil, &ParseError{Path: path, Err: err}
+	}
+	if _, err := migration.DownStrategy(); err != nil {
+		return nil, &ParseError{Path: path, Err: err}
+	}
+	sum := sha256.Sum256(buf)
+	migration.Checksum = hex.EncodeToString(sum[:])
 
 	// check if the csv file exists
-	if _, err := os.Stat(migration.CSVPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("the csv file %s does not exist", migration.CSVPath)
+	if stat != nil {
+		if err := stat(migration.CSVPath); err != nil {
+			return nil, err
+		}
 	}
 
 	return &migration, nil
 }
 
-func CreateMigrationFile(d *DataMigration, m *Migration) (string, error) {
+func CreateMigrationFile(d *DataMigration, m *Migration, stat StatFunc) (string, error) {
 	// Check if the file already exists
 
 	// create the directory if it does not exist
@@ -271,7 +626,16 @@ func CreateMigrationFile(d *DataMigration, m *Migration) (string, error) {
 
 	}
 
-	yml := ToYaml(m)
+	if d.CSVPath != "" && stat != nil {
+		if err := stat(d.CSVPath); err != nil {
+			return "", err
+		}
+	}
+
+	yml, err := toYaml(m, d.CSVPath)
+	if err != nil {
+		return "", err
+	}
 
 	// Create the file
 	file, err := os.Create(d.Path)
@@ -316,19 +680,66 @@ func GetLatest(migrations []*Migration) *Migration {
 	return lastMigration
 }
 
-func ParseMigrationObjects(migrations []string) []*Migration {
+func ParseMigrationObjects(migrations []string) ([]*Migration, error) {
 	var migrationObjects []*Migration
 	for _, migration := range migrations {
 
 		m, err := toMigration(migration)
 		if err != nil {
-			log.Fatalf("An error occurred while parsing the migration: %v", err)
-			os.Exit(1)
+			return nil, err
 		}
 		migrationObjects = append(migrationObjects, m)
 
 	}
-	return migrationObjects
+	return migrationObjects, nil
+}
+
+// ReadMigrations reads the up and down schema migrations of a golang-migrate
+// source driver, e.g. one opened with source.Open or iofs.New. The driver is
+// left open.
+func ReadMigrations(driver source.Driver) ([]*Migration, error) {
+	var migrations []*Migration
+	version, err := driver.First()
+	for err == nil {
+		for _, mtype := range []MigrationType{Up, Down} {
+			m, err := readMigration(driver, version, mtype)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			migrations = append(migrations, m)
+		}
+		version, err = driver.Next(version)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("an error occurred while reading the migrations: %w", err)
+	}
+	return migrations, nil
+}
+
+func readMigration(driver source.Driver, version uint, mtype MigrationType) (*Migration, error) {
+	read := driver.ReadUp
+	if mtype == Down {
+		read = driver.ReadDown
+	}
+	r, name, err := read(version)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("an error occurred while reading migration %d: %w", version, err)
+	}
+	return &Migration{
+		Version:       fmt.Sprintf("%06d", version),
+		Name:          name,
+		MigrationType: mtype,
+		Path:          fmt.Sprintf("%06d_%s.%s.sql", version, name, mtype),
+		SQL:           buf,
+	}, nil
 }
 
 func toMigration(migrationPath string) (*Migration, error) {
@@ -337,14 +748,14 @@ func toMigration(migrationPath string) (*Migration, error) {
 
 	matches := re.FindStringSubmatch(filepath.Base(migrationPath))
 	if len(matches) != 4 {
-		return nil, fmt.Errorf("Migration file %s does not match the expected pattern", migrationPath)
+		return nil, &ParseError{Path: migrationPath, Err: errors.New("the file name does not match the expected pattern")}
 	}
 
 	version := matches[1]
 	name := matches[2]
 	mtype := matches[3]
 	if mtype != "up" && mtype != "down" {
-		return nil, fmt.Errorf("Migration file %s does not match the expected pattern", migrationPath)
+		return nil, &ParseError{Path: migrationPath, Err: errors.New("the file name does not match the expected pattern")}
 	}
 	var migrationType MigrationType
 	if mtype == "up" {
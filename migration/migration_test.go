@@ -0,0 +1,124 @@
+package migration
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestErrorLimit(t *testing.T) {
+	tests := []struct {
+		maxErrors string
+		want      *ErrorLimit
+		wantErr   bool
+	}{
+		{maxErrors: "", want: nil},
+		{maxErrors: "100", want: &ErrorLimit{Limit: 100}},
+		{maxErrors: " 0 ", want: &ErrorLimit{Limit: 0}},
+		{maxErrors: "5%", want: &ErrorLimit{Limit: 5, Percent: true}},
+		{maxErrors: "2.5 %", want: &ErrorLimit{Limit: 2.5, Percent: true}},
+		{maxErrors: "1.5", wantErr: true},
+		{maxErrors: "-1", wantErr: true},
+		{maxErrors: "ten", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.maxErrors, func(t *testing.T) {
+			got, err := MigrationDDL{MaxErrors: tt.maxErrors}.ErrorLimit()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ErrorLimit() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("ErrorLimit() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorLimitExceeded(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    ErrorLimit
+		rejected int64
+		total    int64
+		want     bool
+	}{
+		{"under count", ErrorLimit{Limit: 10}, 9, 100, false},
+		{"at count", ErrorLimit{Limit: 10}, 10, 100, false},
+		{"over count", ErrorLimit{Limit: 10}, 11, 100, true},
+		{"zero count", ErrorLimit{Limit: 0}, 1, 100, true},
+		{"at percent", ErrorLimit{Limit: 5, Percent: true}, 5, 100, false},
+		{"over percent", ErrorLimit{Limit: 5, Percent: true}, 6, 100, true},
+		{"fractional percent", ErrorLimit{Limit: 2.5, Percent: true}, 3, 100, true},
+		{"no rows", ErrorLimit{Limit: 0, Percent: true}, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limit.Exceeded(tt.rejected, tt.total); got != tt.want {
+				t.Errorf("Exceeded(%d, %d) = %v, want %v", tt.rejected, tt.total, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadDataMigrationsFSResolvesPaths(t *testing.T) {
+	fsys := fstest.MapFS{
+		"000001_users.yml": {Data: []byte("version: \"000001\"\ncsv_path: seeds/users.csv\ntable_name: users\npre: sql/pre.sql\ndown_sql: DELETE FROM users\n")},
+		"seeds/users.csv":  {Data: []byte("id\n1\n")},
+		"orders.csv":       {Data: []byte("id\n1\n")},
+		"sql/pre.sql":      {Data: []byte("SELECT 1;")},
+	}
+	var checked []string
+	stat := func(path string) error {
+		checked = append(checked, path)
+		return nil
+	}
+	migrations, err := ReadDataMigrationsFS(fsys, stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*migrations) != 1 {
+		t.Fatalf("read %d data migrations, want 1", len(*migrations))
+	}
+	m := (*migrations)[0]
+	if m.FS == nil {
+		t.Error("FS is not set")
+	}
+	if len(checked) != 1 || checked[0] != "seeds/users.csv" {
+		t.Errorf("checked %q, want the csv_path", checked)
+	}
+	pre, err := m.PreSQL()
+	if err != nil || pre != "SELECT 1;" {
+		t.Errorf("PreSQL() = %q, %v, want the content of sql/pre.sql", pre, err)
+	}
+	down, err := m.DownSQL()
+	if err != nil || down != "DELETE FROM users" {
+		t.Errorf("DownSQL() = %q, %v, want the inline SQL", down, err)
+	}
+}
+
+func TestFSName(t *testing.T) {
+	m := MigrationDDL{FS: fstest.MapFS{}}
+	tests := []struct {
+		path string
+		name string
+		ok   bool
+	}{
+		{"users.csv", "users.csv", true},
+		{"./seeds/../users.csv", "users.csv", true},
+		{"/data/users.csv", "", false},
+		{"s3://bucket/users.csv", "", false},
+	}
+	for _, tt := range tests {
+		if name, ok := m.FSName(tt.path); name != tt.name || ok != tt.ok {
+			t.Errorf("FSName(%q) = %q, %v, want %q, %v", tt.path, name, ok, tt.name, tt.ok)
+		}
+	}
+	if _, ok := (MigrationDDL{}).FSName("users.csv"); ok {
+		t.Error("FSName without FS reads from it")
+	}
+}
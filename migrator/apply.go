@@ -0,0 +1,544 @@
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"time"
+
+	"github.com/datamigrate/csv"
+	"github.com/datamigrate/db"
+	dm "github.com/datamigrate/migration"
+)
+
+// applyVersion applies a data migration. The load, the pre and post SQL, the
+// version bump and the history entry commit or roll back together, so a
+// failed load leaves the previous version in place, clean.
+func (m *Migrator) applyVersion(ctx context.Context, dataMigration *dm.MigrationDDL, version int) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	result, err := m.applyDataMigrationWithHistory(ctx, tx, dataMigration, version)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = db.SetVersionTx(ctx, tx, version, false)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("an error occurred while setting the data migration version: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	m.reportLoad(result)
+	return nil
+}
+
+// applyVersionsAtomic applies a batch of data migrations in one transaction,
+// so that either all of them or none of them are loaded.
+func (m *Migrator) applyVersionsAtomic(ctx context.Context, dataMigrations *[]dm.MigrationDDL, versions []int) error {
+	if len(versions) == 0 {
+		return nil
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	var results []*LoadResult
+	for _, v := range versions {
+		dataMigration, err := dm.GetDataMigrationByVersion(dataMigrations, v)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		m.logf("Running migration file for version: %d %s", v, dataMigration.CSVPath)
+		result, err := m.applyDataMigrationWithHistory(ctx, tx, dataMigration, v)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("version %d: %w", v, err)
+		}
+		results = append(results, result)
+	}
+	err = db.SetVersionTx(ctx, tx, versions[len(versions)-1], false)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("an error occurred while setting the data migration version: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		m.reportLoad(result)
+	}
+	return nil
+}
+
+// revertVersion reverts a data migration. The removal, the switch to the
+// previous version and the history entry commit or roll back together.
+func (m *Migrator) revertVersion(ctx context.Context, dataMigration *dm.MigrationDDL, version int, previous int) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	rows, err := m.revertDataMigration(ctx, tx, dataMigration, version)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = db.InsertHistoryTx(ctx, tx, newHistoryEntry(version, db.DirectionDown, "", rows, time.Since(start)))
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("an error occurred while recording the data migration history: %w", err)
+	}
+	err = db.SetVersionTx(ctx, tx, previous, false)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("an error occurred while setting the data migration version: %w", err)
+	}
+	return tx.Commit()
+}
+
+// reapplyVersion reloads an already applied data migration whose files have
+// changed: the rows it inserted are removed and loaded again in a single
+// transaction. The upsert and sync modes update the table in place instead.
+func (m *Migrator) reapplyVersion(ctx context.Context, dataMigration *dm.MigrationDDL, version int, current int) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if dataMigration.Mode != dm.ModeUpsert && dataMigration.Mode != dm.ModeSync {
+		_, err = m.revertDataMigration(ctx, tx, dataMigration, version)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	result, err := m.applyDataMigrationWithHistory(ctx, tx, dataMigration, version)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = db.SetVersionTx(ctx, tx, current, false)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("an error occurred while setting the data migration version: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	m.reportLoad(result)
+	return nil
+}
+
+// reportLoad passes the result of a committed load to OnLoad.
+func (m *Migrator) reportLoad(result *LoadResult) {
+	if m.OnLoad != nil {
+		m.OnLoad(*result)
+	}
+}
+
+// findDriftedVersions compares the checksums recorded when the given versions
+// were applied with the current YAML and CSV files and returns the versions
+// whose files have changed since. Versions applied before checksums were
+// recorded are skipped.
+func (m *Migrator) findDriftedVersions(ctx context.Context, dataMigrations *[]dm.MigrationDDL, versions []int) ([]int, error) {
+	applied, err := db.GetAppliedChecksums(ctx, m.db)
+	if err != nil {
+		return nil, fmt.Errorf("an error occurred while reading the applied checksums: %w", err)
+	}
+
+	var drifted []int
+	for _, v := range versions {
+		entry, ok := applied[v]
+		if !ok || entry.Checksum == "" {
+			continue
+		}
+		dataMigration, err := dm.GetDataMigrationByVersion(dataMigrations, v)
+		if errors.Is(err, dm.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		changed, err := changedSince(ctx, dataMigration, entry)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			drifted = append(drifted, v)
+		}
+	}
+	return drifted, nil
+}
+
+// changedSince reports whether the CSV or YAML of a data migration differ
+// from the ones recorded by the run that applied it. A remote CSV recorded
+// with an ETag is compared by ETag, other CSVs are read again and hashed. A
+// run recorded without checksums never differs.
+func changedSince(ctx context.Context, dataMigration *dm.MigrationDDL, entry db.HistoryEntry) (bool, error) {
+	if entry.Checksum == "" {
+		return false, nil
+	}
+	if entry.YAMLChecksum != "" && dataMigration.Checksum != entry.YAMLChecksum {
+		return true, nil
+	}
+	if entry.ETag != "" {
+		info, err := csv.Stat(ctx, dataMigration.CSVPath, csv.Options{FS: dataMigration.FS})
+		if err != nil {
+			return false, err
+		}
+		if info.ETag != "" {
+			return info.ETag != entry.ETag, nil
+		}
+	}
+	checksum, err := csv.Checksum(ctx, dataMigration.CSVPath, csv.Options{FS: dataMigration.FS})
+	if err != nil {
+		return false, fmt.Errorf("an error occurred while computing the checksum of %s: %w", dataMigration.CSVPath, err)
+	}
+	return checksum != entry.Checksum, nil
+}
+
+// applyDataMigrationWithHistory applies a data migration and records the run
+// in the history table.
+func (m *Migrator) applyDataMigrationWithHistory(ctx context.Context, tx *sql.Tx, dataMigration *dm.MigrationDDL, version int) (*LoadResult, error) {
+	start := time.Now()
+	result, err := m.applyDataMigration(ctx, tx, dataMigration, version)
+	if err != nil {
+		return nil, err
+	}
+	result.Version = version
+
+	entry := newHistoryEntry(version, db.DirectionUp, result.checksum, result.Loaded, time.Since(start))
+	entry.YAMLChecksum = dataMigration.Checksum
+	entry.ETag = result.etag
+	entry.KeyColumns = result.keyColumns
+	err = db.InsertHistoryTx(ctx, tx, entry)
+	if err != nil {
+		return nil, fmt.Errorf("an error occurred while recording the data migration history: %w", err)
+	}
+	return result, nil
+}
+
+// maxReportedErrors caps the invalid values reported when a load fails.
+const maxReportedErrors = 20
+
+// LoadResult reports the rows a data migration loaded and rejected.
+type LoadResult struct {
+	Version  int
+	Table    string
+	Loaded   int64
+	Rejected int64
+	// RejectsPath is the file holding the rejected rows, if any.
+	RejectsPath string
+
+	// the checksum and ETag of the loaded file and the key columns recorded,
+	// for the history
+	checksum   string
+	etag       string
+	keyColumns []string
+}
+
+// applyDataMigration streams the CSV of a data migration into the target
+// table, checking every value against the type of its column. The file is
+// read once: the rows loaded are the ones checked and hashed for the history.
+// Invalid rows fail the load, unless max_errors is set: they are then written
+// to a rejects file and skipped. Either way nothing is committed when the
+// load fails. The values of the key columns of the inserted rows are recorded
+// under version when the revert needs them.
+func (m *Migrator) applyDataMigration(ctx context.Context, tx *sql.Tx, dataMigration *dm.MigrationDDL, version int) (*LoadResult, error) {
+	limit, err := dataMigration.ErrorLimit()
+	if err != nil {
+		return nil, err
+	}
+	opts := db.LoadOptions{Keys: dataMigration.Keys, Version: version}
+	opts.Mode, err = dataMigration.LoadMode()
+	if err != nil {
+		return nil, err
+	}
+	opts.Pre, err = dataMigration.PreSQL()
+	if err != nil {
+		return nil, err
+	}
+	opts.Post, err = dataMigration.PostSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := m.openCSV(ctx, dataMigration)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.Converter = csv.NewConverter(dataMigration.CSVPath, c.Columns, dataMigration)
+	opts.RecordKeys, err = insertedKeys(ctx, tx, dataMigration, opts.Mode, c.TableColumns())
+	if err != nil {
+		return nil, err
+	}
+
+	// invalid rows are skipped while the others are loaded, and checked once
+	// the whole file is read
+	var invalid invalidRows
+	var rejects *csv.Rejects
+	if limit == nil {
+		c.OnReject = invalid.add
+	} else {
+		dialect, err := csv.DialectFor(dataMigration)
+		if err != nil {
+			return nil, err
+		}
+		rejects, err = csv.NewRejects(dataMigration.CSVPath, c.Columns, dialect, csv.Options{FS: dataMigration.FS})
+		if err != nil {
+			return nil, err
+		}
+		c.OnReject = rejects.Reject
+	}
+
+	// load the csv to the database, wrapped by the pre and post SQL
+	result := &LoadResult{Table: db.TableFor(dataMigration).String()}
+	result.Loaded, err = db.WriteCsvToDb(ctx, tx, c, db.TableFor(dataMigration), opts)
+	if err != nil {
+		if rejects != nil {
+			rejects.Close()
+		}
+		return nil, fmt.Errorf("an error occurred while writing the csv to the database: %w", err)
+	}
+	result.checksum = c.Checksum()
+	result.etag = c.Info().ETag
+	result.keyColumns = opts.RecordKeys
+
+	if limit == nil {
+		if err := invalid.err(); err != nil {
+			return nil, fmt.Errorf("the csv %s has invalid values:\n%w", dataMigration.CSVPath, err)
+		}
+		return result, nil
+	}
+	if err := m.checkRejects(dataMigration, limit, rejects, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// invalidRows collects the invalid rows of a CSV, keeping the first
+// maxReportedErrors reasons.
+type invalidRows struct {
+	count   int
+	reasons []error
+}
+
+func (r *invalidRows) add(row csv.Row, reason error) error {
+	r.count++
+	if len(r.reasons) < maxReportedErrors {
+		r.reasons = append(r.reasons, reason)
+	}
+	return nil
+}
+
+func (r *invalidRows) err() error {
+	errs := r.reasons
+	if r.count > len(errs) {
+		errs = append(errs, fmt.Errorf("and %d more invalid rows", r.count-len(errs)))
+	}
+	return errors.Join(errs...)
+}
+
+// checkRejects closes the rejects file of a load and fails when the rejected
+// rows go over the error limit.
+func (m *Migrator) checkRejects(dataMigration *dm.MigrationDDL, limit *dm.ErrorLimit, rejects *csv.Rejects, result *LoadResult) error {
+	if err := rejects.Close(); err != nil {
+		return fmt.Errorf("an error occurred while writing the rejects file %s: %w", rejects.Path, err)
+	}
+	result.Rejected = rejects.Count
+	if rejects.Count == 0 {
+		return nil
+	}
+	result.RejectsPath = rejects.Path
+	m.logf("Rejected %d rows of %s, written to %s", rejects.Count, dataMigration.CSVPath, rejects.Path)
+
+	total := result.Loaded + rejects.Count
+	if limit.Exceeded(rejects.Count, total) {
+		return &dm.TooManyRejectsError{Rejected: rejects.Count, Total: total, MaxErrors: dataMigration.MaxErrors, RejectsPath: rejects.Path}
+	}
+	return nil
+}
+
+// streamCSV opens the CSV of a data migration with its rows converted to the
+// column types. Invalid rows are skipped when max_errors is set.
+func (m *Migrator) streamCSV(ctx context.Context, dataMigration *dm.MigrationDDL) (*csv.Stream, error) {
+	limit, err := dataMigration.ErrorLimit()
+	if err != nil {
+		return nil, err
+	}
+	c, err := m.openCSV(ctx, dataMigration)
+	if err != nil {
+		return nil, err
+	}
+	c.Converter = csv.NewConverter(dataMigration.CSVPath, c.Columns, dataMigration)
+	if limit != nil {
+		c.OnReject = func(csv.Row, error) error { return nil }
+	}
+	return c, nil
+}
+
+// openCSV opens the CSV, or JSON, of a data migration, maps its header to
+// the migration columns and configures its null markers.
+func (m *Migrator) openCSV(ctx context.Context, dataMigration *dm.MigrationDDL) (*csv.Stream, error) {
+	m.logf("Loading csv from path: %s", dataMigration.CSVPath)
+	c, err := csv.Open(ctx, dataMigration, csv.Options{Progress: m.Progress})
+	if err != nil {
+		return nil, fmt.Errorf("an error occurred while loading the csv: %w", err)
+	}
+	// map the csv columns to the migration columns
+	c.Mapping, err = csv.MapColumns(c.Columns, dataMigration)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("column mismatch: %w", err)
+	}
+	c.Nulls = csv.NullMarkers(c.Columns, dataMigration)
+	return c, nil
+}
+
+// insertedKeys returns the key columns recorded for the rows a data migration
+// inserts into the given columns, so that the delete strategy reverts exactly
+// those rows. Nothing is recorded when it has down SQL or the truncate
+// strategy, or when its table has no keys. An append or replace load whose
+// keys are all in the CSV is reverted by them, and only recorded with
+// record_keys.
+func insertedKeys(ctx context.Context, tx *sql.Tx, dataMigration *dm.MigrationDDL, mode string, columns []string) ([]string, error) {
+	down, err := dataMigration.DownSQL()
+	if err != nil {
+		return nil, err
+	}
+	strategy, err := dataMigration.DownStrategy()
+	if err != nil {
+		return nil, err
+	}
+	if down != "" || strategy != dm.StrategyDelete {
+		return nil, nil
+	}
+	keys, err := db.KeyColumns(ctx, tx, db.TableFor(dataMigration), dataMigration.Keys)
+	if err != nil {
+		return nil, err
+	}
+	if mode == dm.ModeUpsert || mode == dm.ModeSync || dataMigration.RecordKeys {
+		return keys, nil
+	}
+	for _, key := range keys {
+		if !slices.Contains(columns, key) {
+			return keys, nil
+		}
+	}
+	return nil, nil
+}
+
+// revertDataMigration removes the data loaded by a data migration and returns
+// the number of rows removed, when known. The down SQL of the data migration
+// runs if it has one. Otherwise the rows it inserted are deleted, or the table
+// is truncated with the truncate strategy.
+func (m *Migrator) revertDataMigration(ctx context.Context, tx *sql.Tx, dataMigration *dm.MigrationDDL, version int) (int64, error) {
+	down, err := dataMigration.DownSQL()
+	if err != nil {
+		return 0, err
+	}
+	if down != "" {
+		_, err = tx.ExecContext(ctx, down)
+		if err != nil {
+			return 0, fmt.Errorf("an error occurred while running the down SQL: %w", err)
+		}
+		return 0, nil
+	}
+
+	strategy, err := dataMigration.DownStrategy()
+	if err != nil {
+		return 0, err
+	}
+	table := db.TableFor(dataMigration)
+	if strategy == dm.StrategyTruncate {
+		return 0, truncate(ctx, tx, table)
+	}
+
+	entry, applied, err := db.GetAppliedEntryTx(ctx, tx, version)
+	if err != nil {
+		return 0, fmt.Errorf("an error occurred while reading the data migration history: %w", err)
+	}
+	if applied && len(entry.KeyColumns) > 0 {
+		rows, err := db.DeleteInsertedRows(ctx, tx, table, version, entry.KeyColumns)
+		if err != nil {
+			return 0, fmt.Errorf("an error occurred while deleting the rows inserted by version %d: %w", version, err)
+		}
+		return rows, nil
+	}
+	return m.deleteCSVRows(ctx, tx, dataMigration, version, entry)
+}
+
+// deleteCSVRows reverts a data migration whose inserted rows were not
+// recorded, such as an append whose keys are in the CSV, by deleting the rows
+// whose keys are in its CSV. That is only right while the CSV is the one that was loaded, so
+// a changed data migration is refused, and so is a table without keys.
+func (m *Migrator) deleteCSVRows(ctx context.Context, tx *sql.Tx, dataMigration *dm.MigrationDDL, version int, entry db.HistoryEntry) (int64, error) {
+	table := db.TableFor(dataMigration)
+	keys, err := db.KeyColumns(ctx, tx, table, dataMigration.Keys)
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, fmt.Errorf("the table %s has no primary key, set the keys, down_sql or the truncate strategy of version %d to revert it: %w",
+			table, version, dm.ErrNoKeys)
+	}
+
+	changed, err := changedSince(ctx, dataMigration, entry)
+	if err != nil {
+		return 0, err
+	}
+	if changed {
+		return 0, fmt.Errorf("the rows inserted by version %d were not recorded, set its down_sql or the truncate strategy to revert it, and record_keys to revert later changes: %w",
+			version, &dm.DriftError{Versions: []int{version}})
+	}
+
+	c, err := m.streamCSV(ctx, dataMigration)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	rows, err := db.DeleteCsvFromDb(ctx, tx, c, table, keys)
+	if err != nil {
+		return 0, fmt.Errorf("an error occurred while deleting the rows of %s: %w", dataMigration.CSVPath, err)
+	}
+	return rows, nil
+}
+
+func truncate(ctx context.Context, tx *sql.Tx, table db.Table) error {
+	err := db.TruncateTableTx(ctx, tx, table)
+	if err != nil {
+		return fmt.Errorf("an error occurred while truncating table %s: %w", table, err)
+	}
+	return nil
+}
+
+// newHistoryEntry builds a history entry for a run on this machine.
+func newHistoryEntry(version int, direction string, checksum string, rows int64, duration time.Duration) db.HistoryEntry {
+	hostname, _ := os.Hostname()
+	username := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	return db.HistoryEntry{
+		Version:   version,
+		Direction: direction,
+		Checksum:  checksum,
+		Rows:      rows,
+		Duration:  duration,
+		Hostname:  hostname,
+		User:      username,
+	}
+}
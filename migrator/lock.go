@@ -0,0 +1,83 @@
+package migrator
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/datamigrate/db"
+)
+
+// ErrLocked is returned when another migration holds the lock for longer
+// than the lock timeout.
+var ErrLocked = errors.New("another migration is in progress")
+
+// DefaultLockTimeout is how long a migration waits for the lock when the
+// Migrator has no LockTimeout.
+const DefaultLockTimeout = 15 * time.Second
+
+const lockPollInterval = 500 * time.Millisecond
+
+// lock takes the data migration advisory lock on a dedicated connection,
+// waiting up to the lock timeout for another migration to finish. The
+// returned function releases it. The migration itself runs on another
+// connection, so a pool limited to a single connection is refused rather
+// than left waiting forever.
+func (m *Migrator) lock(ctx context.Context) (func(), error) {
+	if m.NoLock {
+		return func() {}, nil
+	}
+	timeout := m.LockTimeout
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+
+	if m.db.Stats().MaxOpenConnections == 1 {
+		return nil, fmt.Errorf("the migration lock needs a connection of its own: allow at least 2 open connections, or set NoLock")
+	}
+
+	// the lock belongs to the session, so it is held on a connection of its own
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("an error occurred while connecting to the database: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		locked, err := db.TryLock(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("an error occurred while taking the migration lock: %w", err)
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			conn.Close()
+			return nil, fmt.Errorf("%w: the lock was not released within %s", ErrLocked, timeout)
+		}
+		if !waiting {
+			m.logf("Another migration is in progress, waiting up to %s for it to finish", timeout)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	return func() {
+		// ctx may be cancelled by now, the lock is released regardless
+		if err := db.Unlock(context.Background(), conn); err != nil {
+			m.logf("An error occurred while releasing the migration lock: %v", err)
+			// drop the connection so that its session, and the lock, end with it
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}, nil
+}
@@ -0,0 +1,28 @@
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestLockRefusesSingleConnectionPool(t *testing.T) {
+	conn, err := sql.Open("postgres", "postgres://localhost:1/none?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetMaxOpenConns(1)
+
+	m := New(conn, "", "")
+	if _, err := m.lock(context.Background()); err == nil {
+		t.Fatal("lock succeeded on a pool of one connection, want an error")
+	}
+
+	m.NoLock = true
+	unlock, err := m.lock(context.Background())
+	if err != nil {
+		t.Fatalf("lock with NoLock = %v, want nil", err)
+	}
+	unlock()
+}
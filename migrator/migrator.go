@@ -0,0 +1,512 @@
+// Package migrator runs data migrations against a database whose schema is
+// managed by golang-migrate. The datamigrate CLI is a thin wrapper around it,
+// and services can use it directly from their startup code or tests.
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"time"
+
+	"github.com/datamigrate/csv"
+	"github.com/datamigrate/db"
+	dm "github.com/datamigrate/migration"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+)
+
+// ErrSchemaDirty is returned when the golang-migrate schema version is dirty.
+var ErrSchemaDirty = errors.New("the current schema version is dirty. Please fix state to continue")
+
+// Migrator applies and reverts the data migrations in a data migrations
+// directory, pinned to the schema migrations of a golang-migrate source.
+type Migrator struct {
+	// Atomic makes Up apply all pending data migrations in one transaction.
+	Atomic bool
+	// FailOnDrift makes Up fail when an applied data migration has changed
+	// since it was applied.
+	FailOnDrift bool
+	// ReapplyChanged makes Up reload the tables of applied data migrations
+	// that have changed since they were applied.
+	ReapplyChanged bool
+	// OnLoad, when set, is called after each data migration is loaded and
+	// committed, with the rows it loaded and rejected.
+	OnLoad func(LoadResult)
+	// NoLock disables the advisory lock that keeps concurrent runs of Up,
+	// Down, Goto and Force from migrating the same database. The lock holds a
+	// connection for the whole run, so it needs a pool of at least 2
+	// connections.
+	NoLock bool
+	// LockTimeout is how long to wait for another migration to release the
+	// lock. Zero means DefaultLockTimeout.
+	LockTimeout time.Duration
+	// Logger receives the messages the Migrator writes as it runs. Nil
+	// discards them.
+	Logger *log.Logger
+	// Progress, when set, reports the bytes read from the data files, e.g.
+	// to draw progress bars. See csv.Options.
+	Progress func(path string, size int64) io.Writer
+
+	db        *sql.DB
+	sourceURL string
+	dataDir   string
+	// schema and data replace sourceURL and dataDir in a Migrator from NewFS
+	schema source.Driver
+	data   fs.FS
+}
+
+// New returns a Migrator for the database conn. sourceURL is the golang-migrate
+// source of the schema migrations, e.g. file:///app/migrations, and dataDir the
+// directory holding the data migration YAML files.
+func New(conn *sql.DB, sourceURL string, dataDir string) *Migrator {
+	return &Migrator{
+		db:        conn,
+		sourceURL: sourceURL,
+		dataDir:   dataDir,
+	}
+}
+
+// NewFS returns a Migrator for the database conn that reads the schema
+// migrations from a golang-migrate source driver and the data migration YAML
+// files from the root of data, e.g. migrations embedded with go:embed:
+//
+//	schema, err := iofs.New(migrationsFS, "migrations")
+//	data, err := fs.Sub(dataMigrationsFS, "datamigrations")
+//	m := migrator.NewFS(conn, schema, data)
+//
+// Relative csv_path and .sql paths of the data migrations are read from data
+// too. The driver is not closed by the Migrator.
+func NewFS(conn *sql.DB, schema source.Driver, data fs.FS) *Migrator {
+	return &Migrator{
+		db:     conn,
+		schema: schema,
+		data:   data,
+	}
+}
+
+// Plan describes the state of the data migrations and what Up would do.
+type Plan struct {
+	SchemaVersion uint
+	DataVersion   uint
+	// Pending are the versions Up would apply, in order.
+	Pending []int
+	// HeldBack are the versions pinned above the current schema version.
+	HeldBack []int
+	// Drifted are the applied versions whose YAML or CSV changed since.
+	Drifted []int
+
+	dataMigrations *[]dm.MigrationDDL
+}
+
+// Plan works out which data migrations Up would apply without changing
+// anything in the database.
+func (m *Migrator) Plan(ctx context.Context) (*Plan, error) {
+	schemaVersion, schemaDirty, err := m.schemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if schemaDirty {
+		return nil, ErrSchemaDirty
+	}
+
+	dataVersion, dataDirty, err := m.dataVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if dataDirty {
+		return nil, &dm.DirtyError{Version: dataVersion}
+	}
+
+	dataMigrations, versions, err := m.readDataMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		SchemaVersion:  schemaVersion,
+		DataVersion:    dataVersion,
+		dataMigrations: dataMigrations,
+	}
+	plan.Pending, plan.HeldBack = dm.PendingVersions(versions, int(dataVersion), int(schemaVersion))
+
+	if db.CheckHistoryTableExists(ctx, m.db) {
+		plan.Drifted, err = m.findDriftedVersions(ctx, dataMigrations, appliedVersions(versions, dataVersion))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// Up applies every data migration above the current data version that is
+// pinned at or below the current schema version.
+func (m *Migrator) Up(ctx context.Context) error {
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = db.CreateDataMigrationTable(ctx, m.db)
+	if err != nil {
+		return fmt.Errorf("an error occurred while creating the data migration table: %w", err)
+	}
+
+	plan, err := m.Plan(ctx)
+	if err != nil {
+		return err
+	}
+	m.logf("Current data migration version %d", plan.DataVersion)
+	m.logf("Current schema version %d", plan.SchemaVersion)
+
+	if len(plan.Drifted) > 0 {
+		m.logf("Data migrations %v have changed since they were applied", plan.Drifted)
+		if m.FailOnDrift {
+			return &dm.DriftError{Versions: plan.Drifted}
+		}
+		if m.ReapplyChanged {
+			for _, v := range plan.Drifted {
+				dataMigration, err := dm.GetDataMigrationByVersion(plan.dataMigrations, v)
+				if err != nil {
+					return err
+				}
+				m.logf("Reapplying changed migration file for version: %d %s", v, dataMigration.CSVPath)
+				err = m.reapplyVersion(ctx, dataMigration, v, int(plan.DataVersion))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if len(plan.HeldBack) > 0 {
+		m.logf("Holding back data migrations %v: they are pinned above the current schema version %d", plan.HeldBack, plan.SchemaVersion)
+	}
+	if len(plan.Pending) == 0 {
+		m.logf("No pending data migrations. The data migration version is %d", plan.DataVersion)
+		return nil
+	}
+
+	if m.Atomic {
+		err = m.applyVersionsAtomic(ctx, plan.dataMigrations, plan.Pending)
+		if err != nil {
+			return err
+		}
+		m.logf("Data migrations %v completed successfully", plan.Pending)
+		return nil
+	}
+
+	for _, v := range plan.Pending {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dataMigration, err := dm.GetDataMigrationByVersion(plan.dataMigrations, v)
+		if err != nil {
+			return err
+		}
+
+		m.logf("Running migration file for version: %d %s", v, dataMigration.CSVPath)
+		err = m.applyVersion(ctx, dataMigration, v)
+		if err != nil {
+			return err
+		}
+		m.logf("Data migration completed successfully")
+	}
+
+	return nil
+}
+
+// Down reverts every applied data migration, newest first.
+func (m *Migrator) Down(ctx context.Context) error {
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return m.migrateDown(ctx, 0)
+}
+
+// Goto applies or reverts data migrations until the data version is version.
+// Version 0 reverts every data migration.
+func (m *Migrator) Goto(ctx context.Context, version int) error {
+	if version < 0 {
+		return fmt.Errorf("invalid version %d: the version must be a non-negative integer", version)
+	}
+
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = db.CreateDataMigrationTable(ctx, m.db)
+	if err != nil {
+		return fmt.Errorf("an error occurred while creating the data migration table: %w", err)
+	}
+
+	schemaVersion, schemaDirty, err := m.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if schemaDirty {
+		return ErrSchemaDirty
+	}
+	if version > int(schemaVersion) {
+		return fmt.Errorf("cannot go to data migration version %d: the schema is only at version %d", version, schemaVersion)
+	}
+
+	current, dirty, err := db.GetDirty(ctx, m.db)
+	if err != nil {
+		return fmt.Errorf("an error occurred while getting the data migration state: %w", err)
+	}
+	if dirty {
+		return &dm.DirtyError{Version: current}
+	}
+	m.logf("Current data migration version %d", current)
+
+	if int(current) == version {
+		m.logf("The current data migration version is already %d. Nothing to do.", version)
+		return nil
+	}
+	if version < int(current) {
+		return m.migrateDown(ctx, version)
+	}
+
+	dataMigrations, versions, err := m.readDataMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	// the target must be one of the known data migrations
+	if _, err := dm.GetDataMigrationByVersion(dataMigrations, version); err != nil {
+		return err
+	}
+
+	// apply every data migration in (current, target]
+	for _, v := range versions {
+		if v <= int(current) || v > version {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dataMigration, err := dm.GetDataMigrationByVersion(dataMigrations, v)
+		if err != nil {
+			return err
+		}
+		m.logf("Running migration file for version: %d %s", v, dataMigration.CSVPath)
+		err = m.applyVersion(ctx, dataMigration, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.logf("Data migrations are now at version %d", version)
+	return nil
+}
+
+// Force records version as the data migration version and clears the dirty
+// flag without running any data migration. It is meant to be used after a
+// failed data migration has been fixed by hand.
+func (m *Migrator) Force(ctx context.Context, version int) error {
+	if version < 0 {
+		return fmt.Errorf("invalid version %d: the version must be a non-negative integer", version)
+	}
+
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = db.CreateDataMigrationTable(ctx, m.db)
+	if err != nil {
+		return fmt.Errorf("an error occurred while creating the data migration table: %w", err)
+	}
+
+	err = db.SetVersion(ctx, m.db, version)
+	if err != nil {
+		return fmt.Errorf("an error occurred while setting the data migration version: %w", err)
+	}
+	return nil
+}
+
+// migrateDown reverts every applied data migration above target, newest first.
+func (m *Migrator) migrateDown(ctx context.Context, target int) error {
+	err := db.CreateDataMigrationTable(ctx, m.db)
+	if err != nil {
+		return fmt.Errorf("an error occurred while creating the data migration table: %w", err)
+	}
+
+	_, schemaDirty, err := m.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if schemaDirty {
+		return ErrSchemaDirty
+	}
+
+	current, dirty, err := db.GetDirty(ctx, m.db)
+	if err != nil {
+		return fmt.Errorf("an error occurred while getting the data migration state: %w", err)
+	}
+	if dirty {
+		return &dm.DirtyError{Version: current}
+	}
+	if int(current) <= target {
+		m.logf("The current data migration version is %d. Nothing to do.", current)
+		return nil
+	}
+	m.logf("Current data migration version %d", current)
+
+	dataMigrations, versions, err := m.readDataMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	if target != 0 {
+		// the target must be one of the known data migrations
+		if _, err := dm.GetDataMigrationByVersion(dataMigrations, target); err != nil {
+			return err
+		}
+	}
+
+	// revert every data migration in (target, current], newest first
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if v > int(current) || v <= target {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dataMigration, err := dm.GetDataMigrationByVersion(dataMigrations, v)
+		if err != nil {
+			return err
+		}
+		m.logf("Reverting data migration for version %d", v)
+		previous := target
+		if i > 0 && versions[i-1] > target {
+			previous = versions[i-1]
+		}
+		err = m.revertVersion(ctx, dataMigration, v, previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = db.SetVersion(ctx, m.db, target)
+	if err != nil {
+		return fmt.Errorf("an error occurred while setting the data migration version: %w", err)
+	}
+	m.logf("Data migrations are now at version %d", target)
+	return nil
+}
+
+// schemaVersion returns the golang-migrate schema version. A database without
+// any schema migration is at version 0.
+func (m *Migrator) schemaVersion(ctx context.Context) (uint, bool, error) {
+	if m.sourceURL == "" && m.schema == nil {
+		return 0, false, fmt.Errorf("the migrations directory is required")
+	}
+
+	// use a dedicated connection so that closing golang-migrate leaves m.db open
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return 0, false, fmt.Errorf("an error occurred while connecting to the database: %w", err)
+	}
+	driver, err := postgres.WithConnection(ctx, conn, &postgres.Config{})
+	if err != nil {
+		conn.Close()
+		return 0, false, fmt.Errorf("an error occurred while connecting to the database: %w", err)
+	}
+	var mg *migrate.Migrate
+	if m.schema != nil {
+		// closing mg closes its source, which belongs to the caller
+		mg, err = migrate.NewWithInstance("schema", keepOpen{m.schema}, "postgres", driver)
+	} else {
+		mg, err = migrate.NewWithDatabaseInstance(m.sourceURL, "postgres", driver)
+	}
+	if err != nil {
+		driver.Close()
+		return 0, false, fmt.Errorf("an error occurred while creating the migration instance: %w", err)
+	}
+	defer mg.Close()
+
+	version, dirty, err := mg.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("an error occurred while getting the current version: %w", err)
+	}
+	return version, dirty, nil
+}
+
+// dataVersion returns the recorded data migration version and whether it is
+// dirty. A database without the data migration table is at version 0.
+func (m *Migrator) dataVersion(ctx context.Context) (uint, bool, error) {
+	if !db.CheckDataMigrationTableExists(ctx, m.db) {
+		return 0, false, nil
+	}
+	version, dirty, err := db.GetDirty(ctx, m.db)
+	if err != nil {
+		return 0, false, fmt.Errorf("an error occurred while getting the data migration state: %w", err)
+	}
+	return version, dirty, nil
+}
+
+// readDataMigrations reads the data migrations and their sorted versions.
+func (m *Migrator) readDataMigrations(ctx context.Context) (*[]dm.MigrationDDL, []int, error) {
+	var dataMigrations *[]dm.MigrationDDL
+	var err error
+	exists := func(path string) error { return csv.Exists(ctx, path, csv.Options{FS: m.data}) }
+	if m.data != nil {
+		dataMigrations, err = dm.ReadDataMigrationsFS(m.data, exists)
+	} else {
+		m.logf("Reading data migrations from %s", m.dataDir)
+		dataMigrations, err = dm.ReadDataMigrations(m.dataDir, exists)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("an error occurred while reading the data migrations: %w", err)
+	}
+	versions, err := dm.ParseVersions(dataMigrations)
+	if err != nil {
+		return nil, nil, fmt.Errorf("an error occurred while parsing the versions: %w", err)
+	}
+	return dataMigrations, versions, nil
+}
+
+// logf writes a message to the Logger, if any.
+func (m *Migrator) logf(format string, args ...any) {
+	if m.Logger != nil {
+		m.Logger.Printf(format, args...)
+	}
+}
+
+// keepOpen is a source driver whose Close leaves the wrapped driver open.
+type keepOpen struct {
+	source.Driver
+}
+
+func (keepOpen) Close() error {
+	return nil
+}
+
+// appliedVersions returns the versions at or below the data version.
+func appliedVersions(versions []int, dataVersion uint) []int {
+	var applied []int
+	for _, v := range versions {
+		if v <= int(dataVersion) {
+			applied = append(applied, v)
+		}
+	}
+	return applied
+}
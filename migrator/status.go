@@ -0,0 +1,144 @@
+package migrator
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/datamigrate/csv"
+	"github.com/datamigrate/db"
+	dm "github.com/datamigrate/migration"
+)
+
+// The states a data migration can be in.
+const (
+	StateApplied = "applied"
+	StatePending = "pending"
+	StateBlocked = "blocked"
+	StateDirty   = "dirty"
+)
+
+// DataMigrationStatus is the state of a single data migration.
+type DataMigrationStatus struct {
+	Version int    `json:"version"`
+	Table   string `json:"table"`
+	CSVPath string `json:"csv_path"`
+	// Rows is the number of rows in the file. For an applied remote file it is
+	// the number of rows loaded, as recorded, so that it is not downloaded.
+	Rows  int    `json:"rows"`
+	State string `json:"state"`
+	// Modified is set for applied data migrations whose YAML or CSV changed
+	// after they were applied.
+	Modified bool `json:"modified"`
+}
+
+// Status is the state of the schema, of the data and of every data migration.
+type Status struct {
+	SchemaVersion  uint                  `json:"schema_version"`
+	SchemaDirty    bool                  `json:"schema_dirty"`
+	DataVersion    uint                  `json:"data_version"`
+	DataDirty      bool                  `json:"data_dirty"`
+	DataMigrations []DataMigrationStatus `json:"data_migrations"`
+}
+
+// Drifted returns the versions of the applied data migrations whose files
+// changed after they were applied.
+func (s *Status) Drifted() []int {
+	var drifted []int
+	for _, d := range s.DataMigrations {
+		if d.Modified {
+			drifted = append(drifted, d.Version)
+		}
+	}
+	return drifted
+}
+
+// Status reports every data migration and its state. Unlike Plan it does not
+// fail on a dirty schema or data version, it reports them.
+func (m *Migrator) Status(ctx context.Context) (*Status, error) {
+	var status Status
+	var err error
+
+	status.SchemaVersion, status.SchemaDirty, err = m.schemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status.DataVersion, status.DataDirty, err = m.dataVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dataMigrations, versions, err := m.readDataMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var drifted []int
+	applied := map[int]db.HistoryEntry{}
+	if db.CheckHistoryTableExists(ctx, m.db) {
+		drifted, err = m.findDriftedVersions(ctx, dataMigrations, appliedVersions(versions, status.DataVersion))
+		if err != nil {
+			return nil, err
+		}
+		applied, err = db.GetAppliedChecksums(ctx, m.db)
+		if err != nil {
+			return nil, fmt.Errorf("an error occurred while reading the applied checksums: %w", err)
+		}
+	}
+
+	status.DataMigrations = []DataMigrationStatus{}
+	for _, v := range versions {
+		dataMigration, err := dm.GetDataMigrationByVersion(dataMigrations, v)
+		if err != nil {
+			return nil, err
+		}
+		state := dataMigrationState(v, &status)
+		modified := state == StateApplied && slices.Contains(drifted, v)
+		var rows int
+		if entry, ok := applied[v]; ok && entry.ETag != "" && state == StateApplied && !modified {
+			rows = int(entry.Rows)
+		} else {
+			rows, err = csv.CountRecords(ctx, dataMigration)
+			if err != nil {
+				return nil, fmt.Errorf("an error occurred while counting the rows of %s: %w", dataMigration.CSVPath, err)
+			}
+		}
+		status.DataMigrations = append(status.DataMigrations, DataMigrationStatus{
+			Version:  v,
+			Table:    db.TableFor(dataMigration).String(),
+			CSVPath:  dataMigration.CSVPath,
+			Rows:     rows,
+			State:    state,
+			Modified: modified,
+		})
+	}
+
+	return &status, nil
+}
+
+// History returns every recorded data migration run, oldest first.
+func (m *Migrator) History(ctx context.Context) ([]db.HistoryEntry, error) {
+	if !db.CheckHistoryTableExists(ctx, m.db) {
+		return []db.HistoryEntry{}, nil
+	}
+	history, err := db.GetHistory(ctx, m.db)
+	if err != nil {
+		return nil, fmt.Errorf("an error occurred while reading the data migration history: %w", err)
+	}
+	return history, nil
+}
+
+// dataMigrationState works out the state of a data migration version from the
+// recorded data and schema versions.
+func dataMigrationState(version int, status *Status) string {
+	switch {
+	case version == int(status.DataVersion) && status.DataDirty:
+		return StateDirty
+	case version <= int(status.DataVersion):
+		return StateApplied
+	case version > int(status.SchemaVersion):
+		return StateBlocked
+	default:
+		return StatePending
+	}
+}
@@ -0,0 +1,124 @@
+// Package s3 reads data migration CSVs from S3 compatible object storage.
+//
+// Credentials, the region and the profile come from the standard AWS
+// environment variables and shared config files. Set AWS_ENDPOINT_URL_S3 or
+// AWS_ENDPOINT_URL to use another endpoint, such as a local MinIO: objects
+// are then addressed path-style.
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// defaultRegion is used when no region is configured, as S3 compatible
+// stores such as MinIO still need one to sign requests.
+const defaultRegion = "us-east-1"
+
+// ErrNotFound is returned when the object or its bucket does not exist.
+var ErrNotFound = errors.New("s3 object not found")
+
+var (
+	clientMu sync.Mutex
+	client   *awss3.Client
+)
+
+// Object describes an S3 object.
+type Object struct {
+	Size int64
+	ETag string
+}
+
+// Parse splits an s3://bucket/key URL into its bucket and key.
+func Parse(rawURL string) (bucket string, key string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	bucket, key = u.Host, strings.TrimPrefix(u.Path, "/")
+	if u.Scheme != "s3" || bucket == "" || key == "" {
+		return "", "", fmt.Errorf("invalid s3 url %q: expected s3://bucket/key", rawURL)
+	}
+	return bucket, key, nil
+}
+
+// Open starts reading the object at the s3:// URL and returns its body, size
+// and ETag. The body is streamed, the caller closes it.
+func Open(ctx context.Context, rawURL string) (io.ReadCloser, Object, error) {
+	bucket, key, err := Parse(rawURL)
+	if err != nil {
+		return nil, Object{}, err
+	}
+	c, err := getClient(ctx)
+	if err != nil {
+		return nil, Object{}, err
+	}
+	out, err := c.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, Object{}, wrapError(rawURL, err)
+	}
+	return out.Body, Object{Size: aws.ToInt64(out.ContentLength), ETag: aws.ToString(out.ETag)}, nil
+}
+
+// Stat checks that the object at the s3:// URL exists with a HEAD request and
+// returns its size and ETag.
+func Stat(ctx context.Context, rawURL string) (Object, error) {
+	bucket, key, err := Parse(rawURL)
+	if err != nil {
+		return Object{}, err
+	}
+	c, err := getClient(ctx)
+	if err != nil {
+		return Object{}, err
+	}
+	out, err := c.HeadObject(ctx, &awss3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return Object{}, wrapError(rawURL, err)
+	}
+	return Object{Size: aws.ToInt64(out.ContentLength), ETag: aws.ToString(out.ETag)}, nil
+}
+
+// getClient returns the S3 client, loading the AWS configuration on first
+// use. A failed load is not kept, so that the next call tries again.
+func getClient(ctx context.Context) (*awss3.Client, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("an error occurred while loading the AWS configuration: %w", err)
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultRegion
+	}
+	client = awss3.NewFromConfig(cfg, func(o *awss3.Options) {
+		// custom endpoints such as MinIO do not support virtual-hosted buckets
+		o.UsePathStyle = o.BaseEndpoint != nil
+	})
+	return client, nil
+}
+
+func wrapError(rawURL string, err error) error {
+	var noKey *types.NoSuchKey
+	var notFound *types.NotFound
+	var noBucket *types.NoSuchBucket
+	var apiErr smithy.APIError
+	if errors.As(err, &noKey) || errors.As(err, &notFound) || errors.As(err, &noBucket) ||
+		(errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound") {
+		return fmt.Errorf("%w: %s", ErrNotFound, rawURL)
+	}
+	return fmt.Errorf("an error occurred while reading %s: %w", rawURL, err)
+}
@@ -2,34 +2,24 @@ package utils
 
 import (
 	"fmt"
-	"log"
-	"os"
 	"path/filepath"
 	"strings"
 )
 
-func GetAbsoluteSourceDir(sourceDir string) string {
+// GetAbsoluteSourceDir returns the golang-migrate source URL of the schema
+// migrations. A directory is turned into an absolute file:// URL, a URL is
+// returned as is. Only the file source driver is built into datamigrate; a URL
+// of another scheme needs its driver imported by the program.
+func GetAbsoluteSourceDir(sourceDir string) (string, error) {
+	if strings.Contains(sourceDir, "://") {
+		return sourceDir, nil
+	}
 	// parse the source directory to get the absolute path
 	sourceDir, err := filepath.Abs(sourceDir)
 	if err != nil {
-		log.Fatalf("An error occurred while getting the absolute path of the migrations directory: %v", err)
-		os.Exit(1)
+		return "", fmt.Errorf("an error occurred while getting the absolute path of the migrations directory: %w", err)
 	}
 	sourceDir = fmt.Sprintf("file://%v", sourceDir)
 
-	return sourceDir
-}
-
-func GetMigrations(source_dir string) ([]string, error) {
-	// Get all the migrations in the source directory
-	dir := filepath.Clean(source_dir)
-	ext := "." + strings.TrimPrefix("sql", ".")
-
-	migrationFiles, err := filepath.Glob(filepath.Join(dir, "*"+ext))
-
-	if err != nil {
-		return nil, err
-	}
-
-	return migrationFiles, nil
+	return sourceDir, nil
 }